@@ -17,7 +17,6 @@ import (
 	_ "embed"
 
 	"github.com/mrcyjanek/simplybs/builder"
-	"github.com/mrcyjanek/simplybs/crash"
 	"github.com/mrcyjanek/simplybs/host"
 	"github.com/mrcyjanek/simplybs/pack"
 )
@@ -47,6 +46,16 @@ func dependencyExists(dep string, packages []*pack.Package) bool {
 	return false
 }
 
+func formatSeconds(seconds float64) string {
+	if seconds < 60 {
+		return fmt.Sprintf("%.1fs", seconds)
+	}
+	if seconds < 3600 {
+		return fmt.Sprintf("%dm %02ds", int(seconds)/60, int(seconds)%60)
+	}
+	return fmt.Sprintf("%dh %02dm", int(seconds)/3600, int(seconds)%3600/60)
+}
+
 func formatFileSize(bytes int64) string {
 	const unit = 1024
 	if bytes < unit {
@@ -155,6 +164,11 @@ func scanBuiltFilesAllPlatforms(packageName string, packageVersion string) []pac
 					fileSize = info.Size()
 				}
 				id := strings.Split(parts[len(parts)-1], ".")[0]
+				logPathRelative := strings.TrimSuffix(archPathRelative, ".tar.gz") + ".log"
+				if _, err := os.Stat(filepath.Join(baseBuildDir, logPathRelative)); err != nil {
+					logPathRelative = ""
+				}
+				stats, _ := pack.ReadBuildStats(filepath.Join(baseBuildDir, strings.TrimSuffix(archPathRelative, ".tar.gz")+".stats.json"))
 
 				builtFiles = append(builtFiles, pack.BuiltFile{
 					Builder:  builderName,
@@ -162,6 +176,8 @@ func scanBuiltFilesAllPlatforms(packageName string, packageVersion string) []pac
 					ID:       id,
 					InfoPath: infoPathRelative,
 					ArchPath: archPathRelative,
+					LogPath:  logPathRelative,
+					Stats:    stats,
 					FileSize: fileSize,
 				})
 			}
@@ -171,8 +187,11 @@ func scanBuiltFilesAllPlatforms(packageName string, packageVersion string) []pac
 	return builtFiles
 }
 
-func getAllPackagesWithBuildsAllPlatforms() []*pack.PackageWithBuilds {
-	packages := pack.GetAllPackages()
+func getAllPackagesWithBuildsAllPlatforms() ([]*pack.PackageWithBuilds, error) {
+	packages, err := pack.GetAllPackages()
+	if err != nil {
+		return nil, err
+	}
 	packagesWithBuilds := make([]*pack.PackageWithBuilds, len(packages))
 
 	for i, pkg := range packages {
@@ -183,21 +202,26 @@ func getAllPackagesWithBuildsAllPlatforms() []*pack.PackageWithBuilds {
 		}
 	}
 
-	return packagesWithBuilds
+	return packagesWithBuilds, nil
 }
 
-func BuildWeb() {
+func BuildWeb() error {
 
 	webDir := filepath.Join(host.DataDirRoot(), "web")
 
 	if _, err := os.Stat(webDir); !os.IsNotExist(err) {
-		err := os.RemoveAll(webDir)
-		crash.Handle(err)
+		if err := os.RemoveAll(webDir); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(webDir, 0755); err != nil {
+		return err
 	}
-	err := os.MkdirAll(webDir, 0755)
-	crash.Handle(err)
 
-	packagesWithBuilds := getAllPackagesWithBuildsAllPlatforms()
+	packagesWithBuilds, err := getAllPackagesWithBuildsAllPlatforms()
+	if err != nil {
+		return err
+	}
 
 	for i, pkg := range packagesWithBuilds {
 		builderTargetMap := make(map[string]pack.BuiltFile)
@@ -235,6 +259,7 @@ func BuildWeb() {
 			return upPath + toPackage + ".html"
 		},
 		"formatFileSize": formatFileSize,
+		"formatSeconds":  formatSeconds,
 		"getMirrorPath": func(pkg *pack.PackageWithBuilds) string {
 			packageDepth := strings.Count(pkg.Package.Package, "/")
 			upPath := strings.Repeat("../", packageDepth+1) // +1 to get out of web directory
@@ -300,18 +325,24 @@ func BuildWeb() {
 	}
 
 	log.Printf("Generating index page...")
-	generateIndexPage(packagesWithBuilds, webDir, funcMap)
+	if err := generateIndexPage(packagesWithBuilds, webDir, funcMap); err != nil {
+		return err
+	}
 
 	log.Printf("Generating %d package pages...", len(packagesWithBuilds))
 	for i, pkgWithBuilds := range packagesWithBuilds {
 		log.Printf("\tProgress: %d/%d packages\n", i+1, len(packagesWithBuilds))
-		generatePackagePage(pkgWithBuilds, webDir, funcMap)
+		if err := generatePackagePage(pkgWithBuilds, webDir, funcMap); err != nil {
+			return err
+		}
 	}
 
 	log.Printf("Generating %d builder matrix pages...\n", len(builder.Builders))
 	for i, builderName := range builder.Builders {
 		log.Printf("\tGenerating matrix for %s (%d/%d)\n", builderName, i+1, len(builder.Builders))
-		generateBuilderMatrixPage(builderName, packagesWithBuilds, webDir, funcMap)
+		if err := generateBuilderMatrixPage(builderName, packagesWithBuilds, webDir, funcMap); err != nil {
+			return err
+		}
 	}
 
 	totalFiles := 0
@@ -323,6 +354,8 @@ func BuildWeb() {
 	fileCount := 0
 	wg := sync.WaitGroup{}
 	semaphore := make(chan struct{}, runtime.NumCPU())
+	var pageErr error
+	var pageErrMutex sync.Mutex
 	for _, pkgWithBuilds := range packagesWithBuilds {
 		for _, builtFile := range pkgWithBuilds.BuiltFiles {
 			fileCount++
@@ -331,69 +364,91 @@ func BuildWeb() {
 			semaphore <- struct{}{}
 			go func(pkgWithBuilds *pack.PackageWithBuilds, builtFile pack.BuiltFile) {
 				defer wg.Done()
-				generateFilePage(pkgWithBuilds, &builtFile, webDir, funcMap)
+				if err := generateFilePage(pkgWithBuilds, &builtFile, webDir, funcMap); err != nil {
+					pageErrMutex.Lock()
+					if pageErr == nil {
+						pageErr = err
+					}
+					pageErrMutex.Unlock()
+				}
 				<-semaphore
 			}(pkgWithBuilds, builtFile)
 		}
 	}
 
 	wg.Wait()
+	if pageErr != nil {
+		return pageErr
+	}
 
 	log.Printf("Generated static website with %d packages, %d builder matrices, and %d file details in %s\n", len(packages), len(builder.Builders), totalFiles, webDir)
+	return nil
 }
 
 //go:embed index.tpl
 var indexTemplate string
 
-func generateIndexPage(packagesWithBuilds []*pack.PackageWithBuilds, webDir string, funcMap template.FuncMap) {
+func generateIndexPage(packagesWithBuilds []*pack.PackageWithBuilds, webDir string, funcMap template.FuncMap) error {
 
 	tmpl, err := template.New("index").Funcs(funcMap).Parse(indexTemplate)
-	crash.Handle(err)
+	if err != nil {
+		return err
+	}
 
 	file, err := os.Create(filepath.Join(webDir, "index.html"))
-	crash.Handle(err)
+	if err != nil {
+		return err
+	}
 	defer file.Close()
 
-	err = tmpl.Execute(file, packagesWithBuilds)
-	crash.Handle(err)
+	return tmpl.Execute(file, packagesWithBuilds)
 }
 
 //go:embed package.tpl
 var packageTemplate string
 
-func generatePackagePage(pkgWithBuilds *pack.PackageWithBuilds, webDir string, funcMap template.FuncMap) {
+func generatePackagePage(pkgWithBuilds *pack.PackageWithBuilds, webDir string, funcMap template.FuncMap) error {
 	funcMap["add"] = func(a, b int) int {
 		return a + b
 	}
 
 	tmpl, err := template.New("package").Funcs(funcMap).Parse(packageTemplate)
-	crash.Handle(err)
+	if err != nil {
+		return err
+	}
 
 	path := filepath.Join(webDir, pkgWithBuilds.Package.Package+".html")
-	err = os.MkdirAll(filepath.Dir(path), 0755)
-	crash.Handle(err)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
 
 	file, err := os.Create(path)
-	crash.Handle(err)
+	if err != nil {
+		return err
+	}
 	defer file.Close()
 
-	err = tmpl.Execute(file, pkgWithBuilds)
-	crash.Handle(err)
+	return tmpl.Execute(file, pkgWithBuilds)
 }
 
 //go:embed builder_matrix.tpl
 var builderMatrixTemplate string
 
-func generateBuilderMatrixPage(builderName string, packagesWithBuilds []*pack.PackageWithBuilds, webDir string, funcMap template.FuncMap) {
+func generateBuilderMatrixPage(builderName string, packagesWithBuilds []*pack.PackageWithBuilds, webDir string, funcMap template.FuncMap) error {
 	tmpl, err := template.New("builder_matrix").Funcs(funcMap).Parse(builderMatrixTemplate)
-	crash.Handle(err)
+	if err != nil {
+		return err
+	}
 
 	path := filepath.Join(webDir, "builder_"+builderName+".html")
-	err = os.MkdirAll(filepath.Dir(path), 0755)
-	crash.Handle(err)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
 
 	file, err := os.Create(path)
-	crash.Handle(err)
+	if err != nil {
+		return err
+	}
 	defer file.Close()
 
 	data := struct {
@@ -404,8 +459,7 @@ func generateBuilderMatrixPage(builderName string, packagesWithBuilds []*pack.Pa
 		Packages: packagesWithBuilds,
 	}
 
-	err = tmpl.Execute(file, data)
-	crash.Handle(err)
+	return tmpl.Execute(file, data)
 }
 
 //go:embed file_details.tpl
@@ -420,7 +474,7 @@ var filePageMutex sync.Mutex
 
 var funcMapMutex sync.Mutex
 
-func generateFilePage(pkg *pack.PackageWithBuilds, builtFile *pack.BuiltFile, webDir string, funcMap template.FuncMap) {
+func generateFilePage(pkg *pack.PackageWithBuilds, builtFile *pack.BuiltFile, webDir string, funcMap template.FuncMap) error {
 	funcMapMutex.Lock()
 	funcMap["getArchiveInfo"] = func(archPath string) ArchiveInfo {
 		baseBuildDir := host.DataDirRoot()
@@ -441,16 +495,21 @@ func generateFilePage(pkg *pack.PackageWithBuilds, builtFile *pack.BuiltFile, we
 
 	filePageMutex.Lock()
 	tmpl, err := template.New("file_details").Funcs(funcMap).Parse(fileDetailsTemplate)
-	crash.Handle(err)
 	filePageMutex.Unlock()
+	if err != nil {
+		return err
+	}
 
 	fileName := fmt.Sprintf("%s-%s-%s.html", pkg.Package.Package, pkg.Package.Version, builtFile.ID)
 	path := filepath.Join(webDir, "files", builtFile.Builder, builtFile.Target, fileName)
-	err = os.MkdirAll(filepath.Dir(path), 0755)
-	crash.Handle(err)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
 
 	file, err := os.Create(path)
-	crash.Handle(err)
+	if err != nil {
+		return err
+	}
 	defer file.Close()
 
 	data := struct {
@@ -461,6 +520,5 @@ func generateFilePage(pkg *pack.PackageWithBuilds, builtFile *pack.BuiltFile, we
 		BuiltFile: builtFile,
 	}
 
-	err = tmpl.Execute(file, data)
-	crash.Handle(err)
+	return tmpl.Execute(file, data)
 }
@@ -196,6 +196,11 @@
             <a href="../../../{{getBuiltFilePath .Package.Package.Package .BuiltFile.InfoPath}}" class="download-btn download-btn-secondary" target="_blank">
                 📄 Build Info
             </a>
+            {{if .BuiltFile.LogPath}}
+            <a href="../../../{{getBuiltFilePath .Package.Package.Package .BuiltFile.LogPath}}" class="download-btn download-btn-secondary" target="_blank">
+                📜 Build Log
+            </a>
+            {{end}}
         </div>
 
         <div class="info-section">
@@ -207,8 +212,26 @@
                 <tr><th>Target</th><td>{{.BuiltFile.Target}}</td></tr>
                 <tr><th>Build ID</th><td><code>{{.BuiltFile.ID}}</code></td></tr>
                 <tr><th>Archive Size</th><td>{{formatFileSize .BuiltFile.FileSize}}</td></tr>
+                {{with .BuiltFile.Stats}}
+                <tr><th>Build Time</th><td>{{formatSeconds .WallSeconds}}</td></tr>
+                <tr><th>CPU Time</th><td>{{formatSeconds .CPUSeconds}}</td></tr>
+                <tr><th>Peak RSS</th><td>{{formatFileSize .MaxRSS}}</td></tr>
+                {{if .Resumed}}<tr><th>Resumed</th><td>yes, not cached</td></tr>{{end}}
+                {{end}}
+            </table>
+        </div>
+
+        {{with .BuiltFile.Stats}}
+        <div class="info-section">
+            <h2>Build Steps</h2>
+            <table class="info-table">
+                <tr><th>Step</th><th>Wall</th><th>CPU</th><th>Peak RSS</th></tr>
+                {{range .Steps}}
+                <tr><td><code>{{.Step}}</code></td><td>{{formatSeconds .WallSeconds}}</td><td>{{formatSeconds .CPUSeconds}}</td><td>{{formatFileSize .MaxRSS}}</td></tr>
+                {{end}}
             </table>
         </div>
+        {{end}}
 
         <div class="info-section">
             <h2>Archive Contents</h2>
@@ -493,6 +493,12 @@
                         <span class="download-detail-label">Build ID:</span>
                         <span class="download-detail-value">{{.ID}}</span>
                     </div>
+                    {{if .Stats}}
+                    <div class="download-detail">
+                        <span class="download-detail-label">Build Time:</span>
+                        <span class="download-detail-value">{{formatSeconds .Stats.WallSeconds}}</span>
+                    </div>
+                    {{end}}
                 </div>
                 <div class="download-buttons">
                     <a href="files/{{.Builder}}/{{.Target}}/{{$.Package.Package}}-{{$.Package.Version}}-{{.ID}}.html" class="download-btn download-btn-primary">
@@ -501,6 +507,11 @@
                     <a href="{{getBuiltFilePath $.Package.Package .ArchPath}}" class="download-btn download-btn-secondary" download>
                         ⬇ Download
                     </a>
+                    {{if .LogPath}}
+                    <a href="{{getBuiltFilePath $.Package.Package .LogPath}}" class="download-btn download-btn-secondary" target="_blank">
+                        📜 Log
+                    </a>
+                    {{end}}
                 </div>
             </div>
             {{end}}
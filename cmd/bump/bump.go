@@ -0,0 +1,145 @@
+package bump
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mrcyjanek/simplybs/cmd/lint"
+	"github.com/mrcyjanek/simplybs/host"
+	"github.com/mrcyjanek/simplybs/pack"
+	"github.com/mrcyjanek/simplybs/utils"
+)
+
+// replaceVersion substitutes oldVersion with newVersion in s, also in the
+// underscore spelling some projects use in tags and URLs (R_2_6_0).
+func replaceVersion(s, oldVersion, newVersion string) string {
+	s = strings.ReplaceAll(s, oldVersion, newVersion)
+	oldUnderscore := strings.ReplaceAll(oldVersion, ".", "_")
+	if oldUnderscore != oldVersion {
+		s = strings.ReplaceAll(s, oldUnderscore, strings.ReplaceAll(newVersion, ".", "_"))
+	}
+	return s
+}
+
+func bumpFile(ctx context.Context, pkgName string, download map[string]interface{}, oldVersion, newVersion string) error {
+	url, _ := download["url"].(string)
+	sourcePath := filepath.Join(host.DataDirRoot(), "source", filepath.Base(url))
+	os.MkdirAll(filepath.Dir(sourcePath), 0755)
+
+	sum, err := utils.FetchFile(ctx, sourcePath, url)
+	if err != nil {
+		os.Remove(sourcePath)
+		return err
+	}
+	log.Printf("[%s] New sha256 is %s", pkgName, sum)
+
+	if sig, ok := download["signature"].(map[string]interface{}); ok {
+		kind, _ := sig["kind"].(string)
+		sigURL, _ := sig["url"].(string)
+		key, _ := sig["key"].(string)
+		sigURL = replaceVersion(sigURL, oldVersion, newVersion)
+		_, err := utils.DownloadSignature(ctx, kind, sourcePath, sigURL, filepath.Join(pack.KeysDir(), key))
+		if err != nil {
+			os.Remove(sourcePath)
+			return err
+		}
+		log.Printf("[%s] Signature verified with %s", pkgName, key)
+		sig["url"] = sigURL
+	}
+
+	download["sha256"] = sum
+	return nil
+}
+
+func bumpGit(ctx context.Context, pkgName string, download map[string]interface{}, oldVersion, newVersion string) error {
+	url, _ := download["url"].(string)
+	tag := newVersion
+	if oldTag, ok := download["tag"].(string); ok && oldTag != "" {
+		tag = replaceVersion(oldTag, oldVersion, newVersion)
+	}
+
+	commit, err := utils.ResolveGitTag(ctx, url, tag)
+	if err != nil {
+		return err
+	}
+	log.Printf("[%s] Tag %s points at %s", pkgName, tag, commit)
+
+	src := utils.GitSource{URL: url, Commit: commit, Tag: tag}
+	if err := utils.DownloadGit(ctx, pkgName, src); err != nil {
+		return err
+	}
+	sourcePath := filepath.Join(host.DataDirRoot(), "source", utils.GitTarballName(src))
+	os.MkdirAll(filepath.Dir(sourcePath), 0755)
+	sum, tree, err := utils.CreateGitTarball(pkgName, src, sourcePath)
+	if err != nil {
+		return err
+	}
+	log.Printf("[%s] New git export sha256 is %s", pkgName, sum)
+
+	download["commit"] = commit
+	download["tag"] = tag
+	download["tree"] = tree
+	download["sha256"] = sum
+	return nil
+}
+
+// Bump sets the version of pkgName to newVersion, rewrites the version in
+// its download URL (and tag for git sources), downloads the new source and
+// pins its checksums. The package file is written in lint's canonical format.
+func Bump(ctx context.Context, pkgName, newVersion string) error {
+	file := filepath.Join(host.GetPackagesDir(), pkgName+".json")
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	var data map[string]interface{}
+	if err := json.Unmarshal(content, &data); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", file, err)
+	}
+
+	oldVersion, _ := data["version"].(string)
+	if oldVersion == newVersion {
+		return fmt.Errorf("package %s is already at version %s", pkgName, newVersion)
+	}
+	log.Printf("[%s] Bumping %s -> %s", pkgName, oldVersion, newVersion)
+	data["version"] = newVersion
+
+	download, ok := data["download"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("package %s has no download section", pkgName)
+	}
+	if url, ok := download["url"].(string); ok && oldVersion != "" {
+		newURL := replaceVersion(url, oldVersion, newVersion)
+		if newURL == url && download["kind"] != "git" {
+			log.Printf("[%s] Warning: url %s does not contain the version, leaving it unchanged", pkgName, url)
+		}
+		download["url"] = newURL
+	}
+
+	switch download["kind"] {
+	case "none":
+	case "git":
+		err = bumpGit(ctx, pkgName, download, oldVersion, newVersion)
+	default:
+		err = bumpFile(ctx, pkgName, download, oldVersion, newVersion)
+	}
+	if err != nil {
+		return err
+	}
+
+	formatted, err := lint.FormatPackage(data)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(file, formatted, 0644); err != nil {
+		return err
+	}
+	log.Printf("[%s] Updated %s", pkgName, file)
+	return nil
+}
@@ -3,13 +3,13 @@ package lint
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
 
-	"github.com/mrcyjanek/simplybs/crash"
 	"github.com/mrcyjanek/simplybs/host"
 	"github.com/mrcyjanek/simplybs/pack"
 	"github.com/ryanuber/go-glob"
@@ -20,119 +20,196 @@ type OrderedPackage struct {
 	Version      string                 `json:"version"`
 	Type         string                 `json:"type"`
 	Download     map[string]interface{} `json:"download,omitempty"`
+	Upstream     map[string]interface{} `json:"upstream,omitempty"`
 	Dependencies []string               `json:"dependencies,omitempty"`
 	Patches      []string               `json:"patches,omitempty"`
+	HostTools    []string               `json:"host_tools,omitempty"`
 	Build        map[string]interface{} `json:"build,omitempty"`
 }
 
-func Lint() {
-	fixFormatting()
-	ensureSaneDependencies()
-
+// Lint formats the package files and checks their names, downloads and
+// dependencies.
+func Lint() error {
+	if err := fixFormatting(); err != nil {
+		return err
+	}
+	return ensureSaneDependencies()
 }
 
-func fixFormatting() {
+func fixFormatting() error {
 	var files []string
 	err := filepath.WalkDir("packages", func(path string, d os.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
-		if !d.IsDir() && strings.HasSuffix(path, ".json") {
+		// rootfs.json is not a package.
+		if !d.IsDir() && strings.HasSuffix(path, ".json") && path != filepath.Join("packages", "rootfs.json") {
 			files = append(files, path)
 		}
 		return nil
 	})
-	crash.Handle(err)
+	if err != nil {
+		return err
+	}
 	for _, file := range files {
 		contentInitial, err := os.ReadFile(file)
-		crash.Handle(err)
+		if err != nil {
+			return err
+		}
 
 		var data map[string]interface{}
 		json.Unmarshal(contentInitial, &data)
 
-		ordered := OrderedPackage{}
-
-		if v, ok := data["package"].(string); ok {
-			ordered.Package = v
-		}
-		if v, ok := data["version"].(string); ok {
-			ordered.Version = v
-		}
-		if v, ok := data["type"].(string); ok {
-			ordered.Type = v
+		contentNew, err := FormatPackage(data)
+		if err != nil {
+			return fmt.Errorf("failed to format %s: %v", file, err)
 		}
-		if v, ok := data["download"].(map[string]interface{}); ok {
-			ordered.Download = v
+
+		if !bytes.Equal(contentNew, contentInitial) {
+			log.Printf("Formatting %s", file)
+			os.WriteFile(file, contentNew, 0644)
 		}
-		if v, ok := data["dependencies"].([]interface{}); ok {
-			nativeDeps := []string{}
-			otherDeps := []string{}
+	}
+	return nil
+}
+
+// FormatPackage returns the canonical representation of a package
+// definition, with fields in a fixed order and dependencies sorted.
+func FormatPackage(data map[string]interface{}) ([]byte, error) {
+	ordered := OrderedPackage{}
+
+	if v, ok := data["package"].(string); ok {
+		ordered.Package = v
+	}
+	if v, ok := data["version"].(string); ok {
+		ordered.Version = v
+	}
+	if v, ok := data["type"].(string); ok {
+		ordered.Type = v
+	}
+	if v, ok := data["download"].(map[string]interface{}); ok {
+		ordered.Download = v
+	}
+	if v, ok := data["upstream"].(map[string]interface{}); ok {
+		ordered.Upstream = v
+	}
+	if v, ok := data["dependencies"].([]interface{}); ok {
+		nativeDeps := []string{}
+		otherDeps := []string{}
 
-			for _, dep := range v {
-				if s, ok := dep.(string); ok {
-					parts := strings.Split(s, ":")
-					depName := parts[len(parts)-1]
-					if strings.HasPrefix(depName, "native") {
-						nativeDeps = append(nativeDeps, s)
-					} else {
-						otherDeps = append(otherDeps, s)
-					}
+		for _, dep := range v {
+			if s, ok := dep.(string); ok {
+				parts := strings.Split(s, ":")
+				depName := parts[len(parts)-1]
+				if strings.HasPrefix(depName, "native") {
+					nativeDeps = append(nativeDeps, s)
+				} else {
+					otherDeps = append(otherDeps, s)
 				}
 			}
-
-			sort.Strings(nativeDeps)
-			sort.Strings(otherDeps)
-			ordered.Dependencies = append(nativeDeps, otherDeps...)
 		}
-		if v, ok := data["patches"].([]interface{}); ok {
-			patches := make([]string, len(v))
-			for i, patch := range v {
-				if s, ok := patch.(string); ok {
-					patches[i] = s
-				}
+
+		sort.Strings(nativeDeps)
+		sort.Strings(otherDeps)
+		ordered.Dependencies = append(nativeDeps, otherDeps...)
+	}
+	if v, ok := data["patches"].([]interface{}); ok {
+		patches := make([]string, len(v))
+		for i, patch := range v {
+			if s, ok := patch.(string); ok {
+				patches[i] = s
 			}
-			ordered.Patches = patches
 		}
-		if v, ok := data["build"].(map[string]interface{}); ok {
-			ordered.Build = v
+		ordered.Patches = patches
+	}
+	if v, ok := data["host_tools"].([]interface{}); ok {
+		for _, tool := range v {
+			if s, ok := tool.(string); ok {
+				ordered.HostTools = append(ordered.HostTools, s)
+			}
 		}
+		sort.Strings(ordered.HostTools)
+	}
+	if v, ok := data["build"].(map[string]interface{}); ok {
+		ordered.Build = v
+	}
 
-		var buf bytes.Buffer
-		encoder := json.NewEncoder(&buf)
-		encoder.SetEscapeHTML(false)
-		encoder.SetIndent("", "    ")
-		err = encoder.Encode(ordered)
-		crash.Handle(err)
-
-		contentNew := bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
-
-		if !bytes.Equal(contentNew, contentInitial) {
-			log.Printf("Formatting %s", file)
-			os.WriteFile(file, contentNew, 0644)
-		}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "    ")
+	if err := encoder.Encode(ordered); err != nil {
+		return nil, err
 	}
+
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
 }
 
-func ensureSaneDependencies() {
-	pkgs := pack.GetAllPackages()
+func ensureSaneDependencies() error {
+	pkgs, err := pack.GetAllPackages()
+	if err != nil {
+		return err
+	}
+	problems := 0
 	for _, pkg := range pkgs {
-		ensureValidName(pkg)
+		if err := ensureValidName(pkg); err != nil {
+			return err
+		}
+		problems += ensureValidDownload(pkg)
 		ensureValidDependencies(pkg)
 	}
-	ensureNoCyclicDependencies(pkgs)
+	if err := ensureNoCyclicDependencies(pkgs); err != nil {
+		return err
+	}
+	if problems > 0 {
+		return fmt.Errorf("found %d download problems", problems)
+	}
+	return nil
 }
 
-func ensureValidName(pkg *pack.Package) {
+func ensureValidName(pkg *pack.Package) error {
 	content, err := os.ReadFile(filepath.Join(host.GetPackagesDir(), pkg.Package+".json"))
 	if err != nil {
 		log.Println(pkg.Package, "not found")
-		return
+		return nil
 	}
 	var foundPackage pack.Package
 	json.Unmarshal(content, &foundPackage)
 	if foundPackage.Package != pkg.Package {
-		log.Fatalf("Package %s has invalid name", pkg.Package)
+		return fmt.Errorf("package %s has invalid name", pkg.Package)
+	}
+	return nil
+}
+
+// ensureValidDownload logs what is wrong with the download of pkg and returns
+// the number of problems.
+func ensureValidDownload(pkg *pack.Package) int {
+	problems := 0
+	problem := func(format string, args ...any) {
+		log.Printf(format, args...)
+		problems++
+	}
+	if sig := pkg.Download.Signature; sig != nil {
+		if pkg.Download.Kind == "git" || pkg.Download.Kind == "none" {
+			problem("Package %s has a signature but no downloaded file to verify", pkg.Package)
+		}
+		if _, err := os.Stat(filepath.Join(pack.KeysDir(), sig.Key)); err != nil {
+			problem("Package %s has invalid signature key %s: %v", pkg.Package, sig.Key, err)
+		}
+	}
+	if pkg.Download.Kind != "git" {
+		return problems
+	}
+	if len(pkg.Download.Commit) != 40 {
+		problem("Package %s is a git source without a full commit hash", pkg.Package)
+	}
+	if pkg.Download.Sha256 == "" {
+		problem("Package %s has no git export sha256 pinned", pkg.Package)
 	}
+	if pkg.Download.Tree == "" {
+		problem("Package %s has no tree hash pinned", pkg.Package)
+	}
+	return problems
 }
 
 func ensureValidDependencies(pkg *pack.Package) {
@@ -161,14 +238,16 @@ func ensureValidDependencies(pkg *pack.Package) {
 	}
 }
 
-func ensureNoCyclicDependencies(pkgs []*pack.Package) {
+func ensureNoCyclicDependencies(pkgs []*pack.Package) error {
 	for _, hostInfo := range host.SupportedHosts {
-		checkCyclesForHost(pkgs, hostInfo.Triplet)
+		if err := checkCyclesForHost(pkgs, hostInfo.Triplet); err != nil {
+			return err
+		}
 	}
-	checkCyclesForHost(pkgs, "all")
+	return checkCyclesForHost(pkgs, "all")
 }
 
-func checkCyclesForHost(pkgs []*pack.Package, hostTriplet string) {
+func checkCyclesForHost(pkgs []*pack.Package, hostTriplet string) error {
 	graph := make(map[string][]string)
 	allPackages := make(map[string]bool)
 
@@ -196,14 +275,15 @@ func checkCyclesForHost(pkgs []*pack.Package, hostTriplet string) {
 
 	for packageName := range allPackages {
 		if color[packageName] == 0 {
-			if dfsCycleDetection(packageName, graph, color, parent, hostTriplet) {
-				return
+			if err := dfsCycleDetection(packageName, graph, color, parent, hostTriplet); err != nil {
+				return err
 			}
 		}
 	}
+	return nil
 }
 
-func dfsCycleDetection(packageName string, graph map[string][]string, color map[string]int, parent map[string]string, hostTriplet string) bool {
+func dfsCycleDetection(packageName string, graph map[string][]string, color map[string]int, parent map[string]string, hostTriplet string) error {
 	color[packageName] = 1
 
 	for _, neighbor := range graph[packageName] {
@@ -220,18 +300,17 @@ func dfsCycleDetection(packageName string, graph map[string][]string, color map[
 				cycle[i], cycle[j] = cycle[j], cycle[i]
 			}
 
-			log.Fatalf("Cyclic dependency detected for host %s: %s", hostTriplet, strings.Join(cycle, " -> "))
-			return true
+			return fmt.Errorf("cyclic dependency detected for host %s: %s", hostTriplet, strings.Join(cycle, " -> "))
 		}
 
 		if color[neighbor] == 0 {
 			parent[neighbor] = packageName
-			if dfsCycleDetection(neighbor, graph, color, parent, hostTriplet) {
-				return true
+			if err := dfsCycleDetection(neighbor, graph, color, parent, hostTriplet); err != nil {
+				return err
 			}
 		}
 	}
 
 	color[packageName] = 2
-	return false
+	return nil
 }
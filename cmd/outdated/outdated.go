@@ -0,0 +1,257 @@
+package outdated
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mrcyjanek/simplybs/host"
+	"github.com/mrcyjanek/simplybs/pack"
+	"github.com/mrcyjanek/simplybs/utils"
+)
+
+const cacheTTL = 24 * time.Hour
+
+type Result struct {
+	Package   string    `json:"package"`
+	Current   string    `json:"current"`
+	Latest    string    `json:"latest,omitempty"`
+	Outdated  bool      `json:"outdated"`
+	Upstream  string    `json:"upstream"`
+	CheckedAt time.Time `json:"checked_at"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type cacheEntry struct {
+	Latest    string    `json:"latest"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+func cachePath() string {
+	return filepath.Join(host.DataDirRoot(), "outdated.json")
+}
+
+func loadCache() map[string]cacheEntry {
+	cache := map[string]cacheEntry{}
+	content, err := os.ReadFile(cachePath())
+	if err != nil {
+		return cache
+	}
+	if err := json.Unmarshal(content, &cache); err != nil {
+		log.Printf("Ignoring invalid outdated cache %s: %v", cachePath(), err)
+		return map[string]cacheEntry{}
+	}
+	return cache
+}
+
+func saveCache(cache map[string]cacheEntry) error {
+	content, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(filepath.Dir(cachePath()), 0755)
+	return os.WriteFile(cachePath(), content, 0644)
+}
+
+func cacheKey(u *pack.Upstream) string {
+	return u.Kind + " " + u.URL + " " + u.Regex
+}
+
+var numberRegexp = regexp.MustCompile(`[0-9]+`)
+
+// compareVersions compares the numeric components of two version strings,
+// so that "tor-0.4.8.17" > "tor-0.4.8.9" and "1.10" > "1.9".
+func compareVersions(a, b string) int {
+	na := numberRegexp.FindAllString(a, -1)
+	nb := numberRegexp.FindAllString(b, -1)
+	for i := 0; i < len(na) && i < len(nb); i++ {
+		x, _ := strconv.Atoi(na[i])
+		y, _ := strconv.Atoi(nb[i])
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	if len(na) != len(nb) {
+		if len(na) < len(nb) {
+			return -1
+		}
+		return 1
+	}
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+func matchVersions(re *regexp.Regexp, candidates []string) []string {
+	var versions []string
+	for _, candidate := range candidates {
+		for _, match := range re.FindAllStringSubmatch(candidate, -1) {
+			if len(match) > 1 {
+				versions = append(versions, match[1])
+			} else {
+				versions = append(versions, match[0])
+			}
+		}
+	}
+	return versions
+}
+
+// githubReleases lists the tags of the published releases at url, a GitHub
+// releases API URL, following its pagination.
+func githubReleases(ctx context.Context, url string) ([]string, error) {
+	if !strings.Contains(url, "per_page=") {
+		if strings.Contains(url, "?") {
+			url += "&per_page=100"
+		} else {
+			url += "?per_page=100"
+		}
+	}
+	pages, err := utils.FetchURLPages(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	var tags []string
+	for _, content := range pages {
+		var releases []struct {
+			TagName    string `json:"tag_name"`
+			Draft      bool   `json:"draft"`
+			Prerelease bool   `json:"prerelease"`
+		}
+		if err := json.Unmarshal(content, &releases); err != nil {
+			return nil, fmt.Errorf("invalid releases JSON from %s: %v", url, err)
+		}
+		for _, release := range releases {
+			if !release.Draft && !release.Prerelease {
+				tags = append(tags, release.TagName)
+			}
+		}
+	}
+	return tags, nil
+}
+
+// LatestVersion queries the upstream of a package and returns the newest
+// version matching its regex.
+func LatestVersion(ctx context.Context, u *pack.Upstream) (string, error) {
+	regex := u.Regex
+	if regex == "" {
+		regex = `^(.*)$`
+	}
+	re, err := regexp.Compile(regex)
+	if err != nil {
+		return "", fmt.Errorf("invalid regex %q: %v", u.Regex, err)
+	}
+
+	var candidates []string
+	switch u.Kind {
+	case "listing":
+		content, err := utils.FetchURL(ctx, u.URL)
+		if err != nil {
+			return "", err
+		}
+		candidates = []string{string(content)}
+	case "github":
+		candidates, err = githubReleases(ctx, u.URL)
+		if err != nil {
+			return "", err
+		}
+	case "git":
+		candidates, err = utils.ListGitTags(ctx, u.URL)
+		if err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("unsupported upstream kind %q", u.Kind)
+	}
+
+	versions := matchVersions(re, candidates)
+	if len(versions) == 0 {
+		return "", fmt.Errorf("no version matching %q found at %s", regex, u.URL)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return compareVersions(versions[i], versions[j]) < 0
+	})
+	return versions[len(versions)-1], nil
+}
+
+// Check compares every package that declares an upstream against its newest
+// release. Upstream answers are cached for a day unless refresh is set.
+func Check(ctx context.Context, refresh bool) ([]Result, error) {
+	cache := loadCache()
+	var results []Result
+	packages, err := pack.GetAllPackages()
+	if err != nil {
+		return nil, err
+	}
+	for _, pkg := range packages {
+		if pkg.Upstream == nil {
+			continue
+		}
+		result := Result{
+			Package:  pkg.Package,
+			Current:  pkg.Version,
+			Upstream: pkg.Upstream.URL,
+		}
+		key := cacheKey(pkg.Upstream)
+		entry, ok := cache[key]
+		if refresh || !ok || time.Since(entry.CheckedAt) > cacheTTL {
+			latest, err := LatestVersion(ctx, pkg.Upstream)
+			if err != nil {
+				result.Error = err.Error()
+				result.CheckedAt = time.Now().UTC()
+				results = append(results, result)
+				continue
+			}
+			entry = cacheEntry{Latest: latest, CheckedAt: time.Now().UTC()}
+			cache[key] = entry
+		}
+		result.Latest = entry.Latest
+		result.CheckedAt = entry.CheckedAt
+		result.Outdated = compareVersions(pkg.Version, entry.Latest) < 0
+		results = append(results, result)
+	}
+	if err := saveCache(cache); err != nil {
+		return nil, err
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Package < results[j].Package
+	})
+	return results, nil
+}
+
+func Outdated(ctx context.Context, asJSON bool, refresh bool) error {
+	results, err := Check(ctx, refresh)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(results)
+	}
+
+	fmt.Printf("%-40s %-20s %-20s %s\n", "PACKAGE", "CURRENT", "LATEST", "STATUS")
+	for _, r := range results {
+		status := "up to date"
+		if r.Error != "" {
+			status = "error: " + r.Error
+		} else if r.Outdated {
+			status = "outdated"
+		}
+		fmt.Printf("%-40s %-20s %-20s %s\n", r.Package, r.Current, r.Latest, status)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package outdated
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/mrcyjanek/simplybs/pack"
+	"github.com/mrcyjanek/simplybs/utils"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.9", "1.10", -1},
+		{"tor-0.4.8.17", "tor-0.4.8.9", 1},
+		{"2.0", "2.0.1", -1},
+		{"v1.2.3", "v1.2.3", 0},
+		{"1.2.3", "v1.2.3", -1},
+		{"3.0.0", "2.99.99", 1},
+	}
+	for _, test := range tests {
+		if got := compareVersions(test.a, test.b); got != test.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+		}
+		if got := compareVersions(test.b, test.a); got != -test.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", test.b, test.a, got, -test.want)
+		}
+	}
+}
+
+func TestLatestVersionListing(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<a href="zlib-1.2.13.tar.gz">zlib-1.2.13.tar.gz</a>
+<a href="zlib-1.3.1.tar.gz">zlib-1.3.1.tar.gz</a>
+<a href="zlib-1.3.tar.gz">zlib-1.3.tar.gz</a>`)
+	}))
+	defer server.Close()
+
+	version, err := LatestVersion(context.Background(), &pack.Upstream{
+		Kind:  "listing",
+		URL:   server.URL,
+		Regex: `zlib-([0-9.]+[0-9])\.tar\.gz`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "1.3.1" {
+		t.Errorf("got %s, want 1.3.1", version)
+	}
+}
+
+func TestLatestVersionGithubPagination(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("per_page") != "100" {
+			t.Errorf("per_page not set in %s", r.URL)
+		}
+		switch r.URL.Query().Get("page") {
+		case "":
+			w.Header().Set("Link", fmt.Sprintf(`<%s/releases?per_page=100&page=2>; rel="next", <%s/releases?per_page=100&page=2>; rel="last"`, server.URL, server.URL))
+			fmt.Fprint(w, `[{"tag_name": "v1.1.0"}, {"tag_name": "v3.0.0-rc1", "prerelease": true}, {"tag_name": "v4.0.0", "draft": true}]`)
+		case "2":
+			w.Header().Set("Link", fmt.Sprintf(`<%s/releases?per_page=100&page=1>; rel="first"`, server.URL))
+			fmt.Fprint(w, `[{"tag_name": "v1.10.0"}, {"tag_name": "v1.9.0"}]`)
+		default:
+			t.Errorf("unexpected page %s", r.URL)
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	version, err := LatestVersion(context.Background(), &pack.Upstream{
+		Kind:  "github",
+		URL:   server.URL + "/releases",
+		Regex: `^v([0-9.]+)$`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "1.10.0" {
+		t.Errorf("got %s, want 1.10.0", version)
+	}
+}
+
+func TestLatestVersionGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir := t.TempDir()
+	repo := filepath.Join(dir, "repo")
+	run := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		cmd.Env = append(cmd.Environ(), "GIT_AUTHOR_NAME=t", "GIT_AUTHOR_EMAIL=t@t", "GIT_COMMITTER_NAME=t", "GIT_COMMITTER_EMAIL=t@t")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	cmd := exec.Command("git", "init", "-q", repo)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v\n%s", err, out)
+	}
+	run("commit", "-q", "--allow-empty", "-m", "one")
+	run("tag", "tor-0.4.8.9")
+	run("tag", "-a", "-m", "annotated", "tor-0.4.8.17")
+	run("tag", "tor-0.4.9.1-alpha")
+	run("tag", "unrelated")
+	bare := filepath.Join(dir, "repo.git")
+	if out, err := exec.Command("git", "clone", "-q", "--bare", repo, bare).CombinedOutput(); err != nil {
+		t.Fatalf("git clone: %v\n%s", err, out)
+	}
+
+	tags, err := utils.ListGitTags(context.Background(), "file://"+bare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"tor-0.4.8.17", "tor-0.4.8.9", "tor-0.4.9.1-alpha", "unrelated"}
+	if fmt.Sprint(tags) != fmt.Sprint(want) {
+		t.Errorf("ListGitTags = %v, want %v", tags, want)
+	}
+
+	version, err := LatestVersion(context.Background(), &pack.Upstream{
+		Kind:  "git",
+		URL:   "file://" + bare,
+		Regex: `^(tor-[0-9]+\.[0-9]+\.[0-9]+\.[0-9]+)$`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "tor-0.4.8.17" {
+		t.Errorf("got %s, want tor-0.4.8.17", version)
+	}
+}
@@ -0,0 +1,146 @@
+package stats
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mrcyjanek/simplybs/host"
+	"github.com/mrcyjanek/simplybs/pack"
+)
+
+const limit = 20
+
+// loadStats returns the newest build record of every package and host built
+// on this builder.
+func loadStats() ([]*pack.BuildStats, error) {
+	newest := map[string]*pack.BuildStats{}
+	builtDir := filepath.Join(host.DataDir(), "built")
+	err := filepath.WalkDir(builtDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".stats.json") {
+			return nil
+		}
+		stats, err := pack.ReadBuildStats(path)
+		if err != nil {
+			log.Printf("Ignoring invalid build record %s: %v", path, err)
+			return nil
+		}
+		key := stats.Host + " " + stats.Package
+		if old, ok := newest[key]; !ok || stats.Started.After(old.Started) {
+			newest[key] = stats
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]*pack.BuildStats, 0, len(newest))
+	for _, stats := range newest {
+		records = append(records, stats)
+	}
+	return records, nil
+}
+
+func formatRSS(bytes int64) string {
+	return fmt.Sprintf("%.0f MiB", float64(bytes)/(1024*1024))
+}
+
+// Stats prints the slowest packages and build steps recorded on this
+// builder.
+func Stats() error {
+	records, err := loadStats()
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		log.Printf("No build records found in %s", filepath.Join(host.DataDir(), "built"))
+		return nil
+	}
+
+	var wall, cpu float64
+	for _, r := range records {
+		wall += r.WallSeconds
+		cpu += r.CPUSeconds
+	}
+	fmt.Printf("%d builds, %.0fs wall time, %.0fs CPU time\n\n", len(records), wall, cpu)
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].WallSeconds > records[j].WallSeconds
+	})
+	fmt.Printf("%-40s %-32s %10s %10s %10s\n", "PACKAGE", "HOST", "WALL", "CPU", "MAX RSS")
+	for i, r := range records {
+		if i == limit {
+			break
+		}
+		fmt.Printf("%-40s %-32s %9.1fs %9.1fs %10s\n", r.Package, r.Host, r.WallSeconds, r.CPUSeconds, formatRSS(r.MaxRSS))
+	}
+
+	type step struct {
+		record *pack.BuildStats
+		stats  pack.StepStats
+	}
+	var steps []step
+	for _, r := range records {
+		for _, s := range r.Steps {
+			steps = append(steps, step{record: r, stats: s})
+		}
+	}
+	sort.Slice(steps, func(i, j int) bool {
+		return steps[i].stats.WallSeconds > steps[j].stats.WallSeconds
+	})
+	fmt.Printf("\n%-40s %10s %10s %10s  %s\n", "PACKAGE", "WALL", "CPU", "MAX RSS", "STEP")
+	for i, s := range steps {
+		if i == limit {
+			break
+		}
+		command := s.stats.Step
+		if len(command) > 60 {
+			command = command[:57] + "..."
+		}
+		fmt.Printf("%-40s %9.1fs %9.1fs %10s  %s\n", s.record.Package, s.stats.WallSeconds, s.stats.CPUSeconds, formatRSS(s.stats.MaxRSS), command)
+	}
+	return nil
+}
+
+// HostTools prints the host tools every package used in its newest
+// -host-tools build without declaring them in host_tools.
+func HostTools() error {
+	records, err := loadStats()
+	if err != nil {
+		return err
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Package != records[j].Package {
+			return records[i].Package < records[j].Package
+		}
+		return records[i].Host < records[j].Host
+	})
+	audited := 0
+	fmt.Printf("%-40s %-32s %s\n", "PACKAGE", "HOST", "UNDECLARED HOST TOOLS")
+	for _, r := range records {
+		if len(r.HostTools) == 0 {
+			continue
+		}
+		audited++
+		undeclared := strings.Join(r.UndeclaredHostTools, " ")
+		if undeclared == "" {
+			undeclared = "-"
+		}
+		fmt.Printf("%-40s %-32s %s\n", r.Package, r.Host, undeclared)
+	}
+	if audited == 0 {
+		log.Printf("No builds audited yet, build with -host-tools audit first")
+	}
+	return nil
+}
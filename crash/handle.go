@@ -2,8 +2,18 @@ package crash
 
 import "log"
 
+var onFatal []func(err error)
+
+// OnFatal registers f to run with the error before Handle exits.
+func OnFatal(f func(err error)) {
+	onFatal = append(onFatal, f)
+}
+
 func Handle(err error) {
 	if err != nil {
+		for _, f := range onFatal {
+			f(err)
+		}
 		log.Fatalln(err)
 	}
 }
@@ -6,8 +6,6 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
-
-	"github.com/mrcyjanek/simplybs/crash"
 )
 
 type Host struct {
@@ -25,8 +23,9 @@ func GetPackagesDir() string {
 			return guessPath
 		}
 	}
-	wd, err := os.Getwd()
-	crash.Handle(err)
+	// Getwd only fails when the working directory was removed, the
+	// relative path then fails on first use.
+	wd, _ := os.Getwd()
 	return filepath.Join(wd, "packages")
 }
 
@@ -34,8 +33,7 @@ func DataDirRoot() string {
 	if os.Getenv("SIMPLYBS_DATA_DIR") != "" {
 		return os.Getenv("SIMPLYBS_DATA_DIR")
 	}
-	buildDir, err := os.Getwd()
-	crash.Handle(err)
+	buildDir, _ := os.Getwd()
 	return filepath.Join(buildDir, ".buildlib")
 }
 
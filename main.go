@@ -1,19 +1,26 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"os"
 	"strings"
 
 	cmd "github.com/mrcyjanek/simplybs/cmd/buildweb"
+	"github.com/mrcyjanek/simplybs/cmd/bump"
 	"github.com/mrcyjanek/simplybs/cmd/lint"
+	"github.com/mrcyjanek/simplybs/cmd/outdated"
+	"github.com/mrcyjanek/simplybs/cmd/stats"
 	"github.com/mrcyjanek/simplybs/crash"
 	"github.com/mrcyjanek/simplybs/host"
 	"github.com/mrcyjanek/simplybs/pack"
+	"github.com/mrcyjanek/simplybs/utils"
 )
 
 func main() {
+	utils.SandboxMain()
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 	argList := flag.Bool("list", false, "List all supported hosts (value is depth)")
 	argHost := flag.String("host", "", "The host to build for")
@@ -27,27 +34,166 @@ func main() {
 	argVersion := flag.Bool("v", false, "Show version")
 	argShell := flag.Bool("shell", false, "Extract source and start shell with build environment")
 	argCleanup := flag.Bool("cleanup", false, "Remove everything except current built archives")
+	argMirror := flag.String("mirror", "", "Copy all package sources and signatures into the given directory for offline builds")
+	argOffline := flag.Bool("offline", false, "Forbid network access, sources must be cached or in a file:// mirror (also SIMPLYBS_OFFLINE=1)")
+	argOutdated := flag.Bool("outdated", false, "Check packages with an upstream for newer versions")
+	argOutdatedJSON := flag.Bool("outdated-json", false, "Print -outdated results as JSON")
+	argOutdatedRefresh := flag.Bool("outdated-refresh", false, "Ignore cached -outdated results")
+	argBump := flag.String("bump", "", "Bump the package to the version given as the next argument (builds it for -host to verify, if set)")
+	argCleanupGit := flag.Bool("cleanup-git", false, "Remove git mirrors not referenced by any package")
+	argLogTail := flag.Int("log-tail", 50, "Number of build log lines printed when a build step fails")
+	argVerbose := flag.Bool("verbose", false, "Print build step output to the terminal in addition to the build log")
+	argStats := flag.Bool("stats", false, "Show the slowest packages and build steps recorded on this builder")
+	argTrace := flag.String("trace", "", "Write a Chrome trace (chrome://tracing, ui.perfetto.dev) of the build session to the given file")
+	argKeepFailed := flag.Bool("keep-failed", false, "Keep the work, staging and env directories of a failed build")
+	argResume := flag.Bool("resume", false, "Continue a build kept with -keep-failed from the failed step, the result is not cached")
+	argResumeStep := flag.Int("resume-step", 0, "Step (as numbered in the build log) to continue from with -resume, instead of the failed one")
+	argShellStep := flag.Int("shell-step", 0, "With -shell, run the build steps up to and including this one (numbered as in the build log) before starting the shell")
+	argShellOnFailure := flag.Bool("shell-on-failure", false, "Start a shell in the environment of a failing build step")
+	argRun := flag.String("run", "", "Run the command given after -- in the build environment of this package for -host and exit with its exit code")
+	argSandbox := flag.Bool("sandbox", false, "Run build steps without network, with a read-only host root (Linux only)")
+	argHostTools := flag.String("host-tools", "", "Run build steps with shims recording the host tools used (audit), or only exposing the allowed ones (enforce)")
+	argHostToolsReport := flag.Bool("host-tools-report", false, "Show the undeclared host tools used by the newest -host-tools build of every package")
+	argFsck := flag.Bool("fsck", false, "Verify the git mirrors, cached sources and built archives")
+	argFsckRepair := flag.Bool("fsck-repair", false, "Like -fsck, and delete the broken entries so that they are downloaded or built again")
+	argKeepGoing := flag.Bool("keep-going", false, "Keep building after a package failed, skip the packages depending on it and print a summary, exits with 1 if anything failed")
+	argJSON := flag.Bool("json", false, "Write newline-delimited JSON events and a final result to stdout, everything else printed goes to stderr")
+	argEvents := flag.String("events", "", "Write newline-delimited JSON events and a final result to the given file")
+	argRootfs := flag.Bool("rootfs", false, "Run build steps in the sandbox, chrooted into the root filesystem declared in rootfs.json (Linux only)")
 	flag.Parse()
+	var eventWriter *pack.EventWriter
+	if *argJSON {
+		eventWriter = pack.NewEventWriter(os.Stdout)
+		// stdout only carries the events.
+		os.Stdout = os.Stderr
+	} else if *argEvents != "" {
+		file, err := os.Create(*argEvents)
+		crash.Handle(err)
+		defer file.Close()
+		eventWriter = pack.NewEventWriter(file)
+	}
+	summary := pack.NewSummary()
+	events := summary.Handle
+	finishEvents := func(exitCode int, err error) {}
+	if eventWriter != nil {
+		events = func(e pack.Event) {
+			summary.Handle(e)
+			eventWriter.Handle(e)
+		}
+		finishEvents = eventWriter.Finish
+		crash.OnFatal(func(err error) { eventWriter.Finish(1, err) })
+		defer eventWriter.Finish(0, nil)
+	}
+	session, err := pack.NewSession(pack.Options{
+		LogTail:        *argLogTail,
+		Verbose:        *argVerbose,
+		KeepFailed:     *argKeepFailed,
+		Resume:         *argResume,
+		ResumeStep:     *argResumeStep,
+		ShellOnFailure: *argShellOnFailure,
+		KeepGoing:      *argKeepGoing,
+		Sandbox:        *argSandbox,
+		Rootfs:         *argRootfs,
+		HostTools:      *argHostTools,
+		Offline:        *argOffline,
+		Events:         events,
+	})
+	crash.Handle(err)
+	ctx := context.Background()
+	if *argOffline {
+		ctx = utils.WithOffline(ctx)
+	}
+	session.HandleInterrupts()
+	if *argTrace != "" {
+		crash.Handle(pack.StartTrace(*argTrace))
+		defer pack.StopTrace()
+		crash.OnFatal(func(error) { pack.StopTrace() })
+	}
 	if *argVersion {
 		fmt.Println("simplybs version 0.0.0")
 		return
 	}
+	dataDirLock, err := pack.LockDataDir(*argCleanup || *argCleanupGit || *argFsckRepair)
+	crash.Handle(err)
+	defer dataDirLock.Release()
 	if *argBuildWeb {
-		cmd.BuildWeb()
+		crash.Handle(cmd.BuildWeb())
 		return
 	}
 	if *argCleanup {
-		pack.Cleanup()
+		crash.Handle(session.Cleanup())
+		return
+	}
+	if *argMirror != "" {
+		crash.Handle(session.Mirror(ctx, *argMirror))
+		return
+	}
+	if *argCleanupGit {
+		crash.Handle(pack.CleanupGitMirrors())
+		return
+	}
+	if *argStats {
+		crash.Handle(stats.Stats())
+		return
+	}
+	if *argFsck || *argFsckRepair {
+		problems, err := pack.Fsck(*argFsckRepair)
+		crash.Handle(err)
+		if problems > 0 && !*argFsckRepair {
+			finishEvents(1, fmt.Errorf("fsck found %d problems", problems))
+			os.Exit(1)
+		}
+		return
+	}
+	if *argHostToolsReport {
+		crash.Handle(stats.HostTools())
 		return
 	}
+	if *argOutdated {
+		crash.Handle(outdated.Outdated(ctx, *argOutdatedJSON, *argOutdatedRefresh))
+		return
+	}
+	if *argBump != "" {
+		if flag.NArg() != 1 {
+			crash.Handle(fmt.Errorf("usage: -bump <package> <version>"))
+		}
+		crash.Handle(bump.Bump(ctx, *argBump, flag.Arg(0)))
+		if *argHost != "" {
+			pkg, err := session.Find(*argBump)
+			crash.Handle(err)
+			for _, h := range strings.Split(*argHost, ",") {
+				if host.SupportedHosts[h] == nil {
+					crash.Handle(fmt.Errorf("host %s not supported", h))
+				}
+				crash.Handle(session.Build(ctx, pkg, host.SupportedHosts[h]))
+			}
+		}
+		return
+	}
+	if *argRun != "" {
+		if flag.NArg() == 0 || strings.Contains(*argHost, ",") {
+			crash.Handle(fmt.Errorf("usage: -host <host> -run <package> -- <command...>"))
+		}
+		h := host.SupportedHosts[*argHost]
+		if h == nil {
+			crash.Handle(fmt.Errorf("host %s not supported", *argHost))
+		}
+		pkg, err := session.Find(*argRun)
+		crash.Handle(err)
+		code, err := session.Run(ctx, pkg, h, flag.Args())
+		crash.Handle(err)
+		finishEvents(code, nil)
+		os.Exit(code)
+	}
 	if *argLint {
-		lint.Lint()
+		crash.Handle(lint.Lint())
 		return
 	}
 
 	packageNames := []*pack.Package{}
 	if *argWorld {
-		packageNames = pack.GetAllPackages()
+		packageNames, err = pack.GetAllPackages()
+		crash.Handle(err)
 	} else {
 		packageNames = pack.GetPackagesByList(*argPkg)
 	}
@@ -55,9 +201,28 @@ func main() {
 	if len(packageNames) == 0 {
 		crash.Handle(fmt.Errorf("no valid -package names or -world provided"))
 	}
+	if session.IsOffline() && (*argDownload || *argBuild || *argShell) {
+		checkHosts := []*host.Host{}
+		if !*argDownload {
+			for _, h := range strings.Split(*argHost, ",") {
+				if host.SupportedHosts[h] != nil {
+					checkHosts = append(checkHosts, host.SupportedHosts[h])
+				}
+			}
+		}
+		missing, err := session.MissingSources(ctx, packageNames, checkHosts)
+		crash.Handle(err)
+		if len(missing) > 0 {
+			log.Printf("Offline mode: %d sources are not available locally:", len(missing))
+			for _, m := range missing {
+				log.Printf("  %s", m)
+			}
+			crash.Handle(fmt.Errorf("missing sources in offline mode"))
+		}
+	}
 	if *argDownload {
 		for _, pkg := range packageNames {
-			pkg.DownloadSource()
+			crash.Handle(session.Download(ctx, pkg))
 		}
 		log.Println("Downloaded all sources")
 		return
@@ -69,43 +234,72 @@ func main() {
 		if host == nil {
 			crash.Handle(fmt.Errorf("host %s not supported", h))
 		}
-		buildForHost(host, packageNames, *argList, *argExtract, *argBuild, *argShell)
+		buildForHost(ctx, session, host, packageNames, *argList, *argExtract, *argBuild, *argShell, *argShellStep, *argKeepGoing)
 		if *argBuildWeb {
-			cmd.BuildWeb()
+			crash.Handle(cmd.BuildWeb())
+		}
+	}
+	if *argKeepGoing && *argBuild {
+		summary.Print()
+		if failed := len(summary.Packages(pack.OutcomeFailed)); failed > 0 {
+			finishEvents(1, fmt.Errorf("%d packages failed", failed))
+			os.Exit(1)
 		}
 	}
 }
 
-func buildForHost(host *host.Host, packageNames []*pack.Package, list bool, extract bool, build bool, shell bool) {
+func buildForHost(ctx context.Context, session *pack.Session, host *host.Host, packageNames []*pack.Package, list bool, extract bool, build bool, shell bool, shellStep int, keepGoing bool) {
 	if list {
 		for _, pkg := range packageNames {
-			pack.PrintPackage(pkg.Package, host.Triplet)
+			crash.Handle(pack.PrintPackage(pkg.Package, host.Triplet))
 		}
 		return
 	}
 
 	if extract {
+		l, err := pack.LockEnv(host)
+		crash.Handle(err)
 		for _, pkg := range packageNames {
-			pkg.ExtractEnv(host, host.GetEnvPath())
+			crash.Handle(session.Extract(ctx, pkg, host, host.GetEnvPath()))
 		}
+		l.Release()
 	}
 
+	failed := map[*pack.Package]bool{}
 	if build {
 		for _, pkg := range packageNames {
-			pkg.EnsureBuilt(host, true)
+			// With -keep-going the build reports the same error.
+			if _, err := session.Resolve(pkg, host); !keepGoing {
+				crash.Handle(err)
+			}
+		}
+		for _, pkg := range packageNames {
+			err := session.Build(ctx, pkg, host)
+			if err != nil && keepGoing {
+				log.Println(err)
+				failed[pkg] = true
+				continue
+			}
+			crash.Handle(err)
 		}
 	}
 	if extract {
+		l, err := pack.LockEnv(host)
+		crash.Handle(err)
 		for _, pkg := range packageNames {
+			if failed[pkg] {
+				continue
+			}
 			log.Printf("Extracting env for package: %s", pkg.Package)
-			pkg.ExtractEnv(host, host.GetEnvPath())
+			crash.Handle(session.Extract(ctx, pkg, host, host.GetEnvPath()))
 		}
+		l.Release()
 	}
 
 	if shell {
 		if len(packageNames) != 1 {
 			crash.Handle(fmt.Errorf("shell option requires exactly one package, got %d", len(packageNames)))
 		}
-		packageNames[0].StartShell(host)
+		crash.Handle(session.Shell(ctx, packageNames[0], host, shellStep))
 	}
 }
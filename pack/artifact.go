@@ -0,0 +1,102 @@
+package pack
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/mrcyjanek/simplybs/host"
+	"github.com/mrcyjanek/simplybs/utils"
+)
+
+// archiveSumPrefix separates the package info in .info.txt from the sha256
+// of the archive it describes.
+const archiveSumPrefix = "\n\narchive-sha256: "
+
+// builtInfo is the content of .info.txt for an archive with the given
+// sha256.
+func builtInfo(info, archiveSum string) string {
+	return info + archiveSumPrefix + archiveSum + "\n"
+}
+
+// readBuiltInfo returns the package info and archive sha256 recorded in an
+// .info.txt, the sha256 is empty for files written before it was recorded.
+func readBuiltInfo(path string) (info, archiveSum string, err error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", "", err
+	}
+	info, archiveSum, _ = strings.Cut(string(content), archiveSumPrefix)
+	return info, strings.TrimSpace(archiveSum), nil
+}
+
+// verifiedArchives caches archive checksums by path, size and modification
+// time, so that every archive is hashed once per run.
+var verifiedArchives sync.Map
+
+func archiveSum(path string) (string, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	key := fmt.Sprintf("%s %d %d", path, stat.Size(), stat.ModTime().UnixNano())
+	if sum, ok := verifiedArchives.Load(key); ok {
+		return sum.(string), nil
+	}
+	sum, err := utils.FileSha256(path)
+	if err != nil {
+		return "", err
+	}
+	verifiedArchives.Store(key, sum)
+	return sum, nil
+}
+
+// cacheStatus reports whether the build cache of p for h can be used, and
+// otherwise why not.
+func (p *Package) cacheStatus(h *host.Host) (bool, string) {
+	built, err := p.GenerateBuildPath(h, "built")
+	if err != nil {
+		return false, err.Error()
+	}
+	info, sum, err := readBuiltInfo(built + ".info.txt")
+	if err != nil {
+		return false, "No build cache found"
+	}
+	current, err := p.GeneratePackageInfo(h)
+	if err != nil {
+		return false, err.Error()
+	}
+	if info != current {
+		return false, "Build cache found, but info mismatch"
+	}
+	if sum == "" {
+		return false, "Build cache has no archive checksum"
+	}
+	actual, err := archiveSum(built + ".tar.gz")
+	if err != nil {
+		return false, fmt.Sprintf("Build cache found, but the archive is unreadable (%v)", err)
+	}
+	if actual != sum {
+		return false, "Build cache found, but the archive does not match its checksum"
+	}
+	return true, ""
+}
+
+// writeBuiltInfo records that the archive of p for h is complete and
+// matches the current package info.
+func (p *Package) writeBuiltInfo(h *host.Host) error {
+	built, err := p.GenerateBuildPath(h, "built")
+	if err != nil {
+		return err
+	}
+	info, err := p.GeneratePackageInfo(h)
+	if err != nil {
+		return err
+	}
+	sum, err := archiveSum(built + ".tar.gz")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(built+".info.txt", []byte(builtInfo(info, sum)), 0644)
+}
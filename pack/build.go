@@ -1,64 +1,292 @@
 package pack
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/mrcyjanek/simplybs/host"
 	"github.com/mrcyjanek/simplybs/utils"
 	"github.com/ryanuber/go-glob"
 )
 
-func (p *Package) EnsureBuilt(h *host.Host, buildDependencies bool) {
-	buildPath := p.GenerateBuildPath(h, "built") + ".info.txt"
-	info, err := os.ReadFile(buildPath)
+// IsBuilt reports whether EnsureBuilt would find a matching build cache.
+func (p *Package) IsBuilt(h *host.Host) bool {
+	ok, _ := p.cacheStatus(h)
+	return ok
+}
+
+// EnsureBuilt builds p and its dependencies for h unless the build cache
+// can be used.
+func (p *Package) EnsureBuilt(ctx context.Context, h *host.Host) error {
+	c := p.config()
+	key := h.Triplet + " " + p.Package
+	if err, ok := c.failures.Load(key); ok {
+		return err.(error)
+	}
+	err := p.ensureBuilt(ctx, h)
+	if err != nil && c.KeepGoing {
+		c.failures.Store(key, err)
+	}
+	return err
+}
+
+func (p *Package) ensureBuilt(ctx context.Context, h *host.Host) error {
+	built, err := p.GenerateBuildPath(h, "built")
 	if err != nil {
-		log.Printf("[%s] No build cache found, building...", p.Package)
-		p.BuildPackage(h, true)
-		return
+		return err
 	}
-	if string(info) == p.GeneratePackageInfo(h) {
+	ok, reason := p.cacheStatus(h)
+	if ok {
 		log.Printf("[%s] Build cache found, skipping build...", p.Package)
-		return
+		emit(EventCacheHit, p, h, Event{Path: built + ".tar.gz"})
+		return nil
+	}
+	l, err := p.lockBuild(h)
+	if err != nil {
+		return err
+	}
+	defer l.Release()
+	if ok, _ := p.cacheStatus(h); ok {
+		log.Printf("[%s] Built by another process in the meantime, skipping build...", p.Package)
+		emit(EventCacheHit, p, h, Event{Path: built + ".tar.gz"})
+		return nil
+	}
+	log.Printf("[%s] %s, building...", p.Package, reason)
+	emit(EventCacheMiss, p, h, Event{Reason: reason})
+	return p.BuildPackage(ctx, h)
+}
+
+// DependencyError is returned for a package that was skipped because one of
+// its dependencies failed to build.
+type DependencyError struct {
+	Package string
+	// Failed is the dependency whose own build failed with Err.
+	Failed string
+	Err    error
+}
+
+func (e *DependencyError) Error() string {
+	return fmt.Sprintf("[%s] skipped, dependency %s failed: %v", e.Package, e.Failed, e.Err)
+}
+
+func (e *DependencyError) Unwrap() error {
+	return e.Err
+}
+
+func dependencyFailed(p, dep *Package, err error) *DependencyError {
+	if depErr, ok := err.(*DependencyError); ok {
+		return &DependencyError{Package: p.Package, Failed: depErr.Failed, Err: depErr.Err}
+	}
+	return &DependencyError{Package: p.Package, Failed: dep.Package, Err: err}
+}
+
+// validate checks the host patterns of the dependencies, env vars and
+// steps of p, which FindPackage leaves to -lint.
+func (p *Package) validate() error {
+	for _, dep := range p.Dependencies {
+		if !strings.Contains(dep, ":") {
+			return fmt.Errorf("[%s] invalid dependency: %s", p.Package, dep)
+		}
+	}
+	for _, env := range p.Build.Env {
+		if !utils.ValidEnvVar(env) {
+			return fmt.Errorf("[%s] invalid env var: %s, vars need to be in the form of all:KEY=VALUE", p.Package, env)
+		}
+	}
+	for _, step := range p.Build.Steps {
+		if !strings.Contains(step, ":") {
+			return fmt.Errorf("[%s] invalid step: %s", p.Package, step)
+		}
+	}
+	return nil
+}
+
+// matchHost strips the host pattern from a dependency or step and reports
+// whether it applies to h.
+func matchHost(entry string, h *host.Host) (string, bool) {
+	prefix, rest, ok := strings.Cut(entry, ":")
+	if !ok || (!glob.Glob(prefix, h.Triplet) && prefix != "all") {
+		return rest, false
 	}
-	log.Printf("[%s] Build cache found, but info mismatch, rebuilding...", p.Package)
-	p.BuildPackage(h, true)
+	return rest, true
 }
 
-func (p *Package) ExtractEnv(host *host.Host, envPath string) {
-	archive := p.GenerateBuildPath(host, "built") + ".tar.gz"
-	err := utils.ExtractTarGz(archive, envPath)
+// HostDependencies resolves the dependencies of p that apply to h.
+func (p *Package) HostDependencies(h *host.Host) ([]*Package, error) {
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	var deps []*Package
+	for _, dep := range p.Dependencies {
+		name, ok := matchHost(dep, h)
+		if !ok {
+			continue
+		}
+		d, err := p.config().find(name)
+		if err != nil {
+			return nil, fmt.Errorf("[%s] dependency %s not found: %v", p.Package, name, err)
+		}
+		deps = append(deps, d)
+	}
+	return deps, nil
+}
+
+// ExtractEnv extracts the built archive of p for h into envPath.
+func (p *Package) ExtractEnv(h *host.Host, envPath string) error {
+	built, err := p.GenerateBuildPath(h, "built")
 	if err != nil {
-		log.Fatalf("Failed to extract archive %s: %v", archive, err)
+		return err
 	}
+	archive := built + ".tar.gz"
+	if err := utils.ExtractTarGz(archive, envPath); err != nil {
+		return fmt.Errorf("failed to extract archive %s: %v", archive, err)
+	}
+	emit(EventExtract, p, h, Event{Path: envPath})
+	return nil
+}
+
+// DownloadSource downloads the source of p into the source cache, unless it
+// is there already.
+func (p *Package) DownloadSource(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := p.downloadSource(ctx); err != nil {
+		return fmt.Errorf("failed to download source: %v", err)
+	}
+	return nil
 }
 
-func (p *Package) DownloadSource() {
-	sourcePath := p.GenerateBuildPath(&host.Host{}, "source")
+func (p *Package) downloadSource(ctx context.Context) error {
+	sourcePath := p.SourcePath()
 	os.MkdirAll(filepath.Dir(sourcePath), 0755)
 	if p.Download.Kind == "none" {
-		return
+		return nil
+	}
+	l, err := lockSource(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer l.Release()
+	if _, err := os.Stat(sourcePath); !os.IsNotExist(err) {
+		// Cached sources are verified too, they may have been copied in from
+		// elsewhere.
+		return p.verifySignature(ctx, sourcePath)
+	}
+	emit(EventDownloadStart, p, nil, Event{Path: sourcePath})
+	if err := p.fetchSource(p.withProgress(ctx), sourcePath); err != nil {
+		emit(EventDownloadFinish, p, nil, Event{Path: sourcePath, Error: err.Error()})
+		return err
+	}
+	emit(EventDownloadFinish, p, nil, Event{Path: sourcePath})
+	return nil
+}
+
+func (p *Package) fetchSource(ctx context.Context, sourcePath string) error {
+	if p.Download.Kind == "git" {
+		return p.downloadGitSource(ctx, sourcePath)
+	}
+	err := utils.DownloadFile(ctx, p.Package, sourcePath, p.Download.URL, p.Download.Sha256, false)
+	if err != nil {
+		return err
+	}
+	if err := p.verifySignature(ctx, sourcePath); err != nil {
+		os.Remove(sourcePath)
+		return err
+	}
+	return nil
+}
+
+// KeysDir holds the trusted keys referenced by package signatures.
+func KeysDir() string {
+	return filepath.Join(host.GetPackagesDir(), "keys")
+}
+
+func (p *Package) verifySignature(ctx context.Context, sourcePath string) error {
+	sig := p.Download.Signature
+	if sig == nil {
+		return nil
+	}
+	_, err := utils.DownloadSignature(ctx, sig.Kind, sourcePath, sig.URL, filepath.Join(KeysDir(), sig.Key))
+	if err != nil {
+		return fmt.Errorf("[%s] %v", p.Package, err)
 	}
-	if _, err := os.Stat(sourcePath); os.IsNotExist(err) {
+	log.Printf("[%s] Signature verified with %s", p.Package, sig.Key)
+	return nil
+}
+
+// downloadGitSource produces the deterministic tarball of a git source,
+// preferring a verified copy from the source mirror over fetching the
+// repository.
+func (p *Package) downloadGitSource(ctx context.Context, sourcePath string) error {
+	// A mirror export is only trusted when the package pins what it must
+	// contain, otherwise the mirror would decide the source.
+	sum := p.Download.Sha256
+	if sum == "" && p.Download.Tree != "" {
+		// The tree is verified after the download, the sha256 of the mirror
+		// index only names the file.
 		var err error
-		if p.Download.Kind == "git" {
-			err = utils.DownloadGit(p.Package, sourcePath, p.Download.URL, p.Download.Sha256)
-		} else {
-			err = utils.DownloadFile(p.Package, sourcePath, p.Download.URL, p.Download.Sha256, false)
-		}
+		sum, err = mirrorSha256(ctx, filepath.Base(sourcePath), p.Download.Commit)
 		if err != nil {
-			log.Fatalf("Failed to download source: %v", err)
+			log.Printf("[%s] No sha256 pinned and none in the mirror index: %v", p.Package, err)
+		}
+	}
+	if sum != "" {
+		err := utils.DownloadFromMirror(ctx, p.Package, sourcePath, sum)
+		if err == nil {
+			err = utils.VerifyGitTarball(p.GitSource(), sourcePath)
+			if err == nil {
+				return nil
+			}
+			os.Remove(sourcePath)
 		}
+		log.Printf("Failed to download git export from mirror: %v, fetching repository", err)
+	}
+
+	err := utils.DownloadGit(ctx, p.Package, p.GitSource())
+	if err != nil {
+		return err
+	}
+	sum, _, err = utils.CreateGitTarball(p.Package, p.GitSource(), sourcePath)
+	if err != nil {
+		return err
+	}
+	if p.Download.Sha256 == "" {
+		log.Printf("[%s] No sha256 pinned, git export sha256 is %s", p.Package, sum)
+	} else if sum != p.Download.Sha256 {
+		os.Remove(sourcePath)
+		return fmt.Errorf("SHA256 hash mismatch for %s: expected %s, got %s", sourcePath, p.Download.Sha256, sum)
 	}
+	return nil
 }
 
-func (p *Package) ExtractSource(host *host.Host, buildPath string) {
-	sourcePath := p.GenerateBuildPath(host, "source")
-	p.DownloadSource()
-	var err error
+func (p *Package) GitSource() utils.GitSource {
+	return utils.GitSource{
+		URL:    p.Download.URL,
+		Commit: p.Download.Commit,
+		Tag:    p.Download.Tag,
+		Ref:    p.Download.Ref,
+		Tree:   p.Download.Tree,
+	}
+}
+
+// ExtractSource downloads the source of p if needed and extracts it into
+// buildPath.
+func (p *Package) ExtractSource(ctx context.Context, host *host.Host, buildPath string) error {
+	sourcePath := p.SourcePath()
+	endDownload := traceSpan("download", "download", map[string]string{"package": p.Package})
+	err := p.DownloadSource(ctx)
+	endDownload()
+	if err != nil {
+		return err
+	}
+	defer traceSpan("extract source", "extract", map[string]string{"package": p.Package})()
 	switch p.Download.Kind {
 	case "tar.bz2":
 		err = utils.ExtractTarBz2(sourcePath, buildPath)
@@ -67,183 +295,416 @@ func (p *Package) ExtractSource(host *host.Host, buildPath string) {
 	case "tar.xz":
 		err = utils.ExtractTarXz(sourcePath, buildPath)
 	case "git":
-		os.MkdirAll(buildPath, 0755)
-		err = os.CopyFS(buildPath, os.DirFS(sourcePath))
+		err = utils.ExtractTar(sourcePath, buildPath)
 	case "none":
-		return
+		return nil
 	default:
-		log.Fatalf("Unsupported archive kind: %s", p.Download.Kind)
+		return fmt.Errorf("[%s] unsupported archive kind: %s", p.Package, p.Download.Kind)
 	}
 	if err != nil {
-		log.Fatalf("Failed to extract archive %s: %v", sourcePath, err)
+		return fmt.Errorf("failed to extract archive %s: %v", sourcePath, err)
 	}
+	return nil
 }
 
-func (p *Package) BuildPackage(h *host.Host, buildDependencies bool) {
-
-	p.buildPackageInternal(h, buildDependencies)
-}
-
-func (p *Package) buildPackageInternal(h *host.Host, buildDependencies bool) {
-	var deps []*Package
-	if buildDependencies {
-		for _, dep := range p.Dependencies {
-			if strings.Contains(dep, ":") {
-				prefix := strings.Split(dep, ":")[0]
-				if !glob.Glob(prefix, h.Triplet) && prefix != "all" {
-					continue
-				}
-				dep = dep[strings.Index(dep, ":")+1:]
-			} else {
-				log.Fatalf("Invalid dependency: %s", dep)
-			}
-			d, err := FindPackage(dep)
-			if err != nil {
-				log.Fatalf("Package %s not found in build", dep)
-			}
-			deps = append(deps, d)
-			d.EnsureBuilt(h, false)
+// BuildPackage builds the dependencies of p that are not cached and then p
+// itself, writing its artifact to the built directory.
+func (p *Package) BuildPackage(ctx context.Context, h *host.Host) (err error) {
+	c := p.config()
+	buildID, err := p.GeneratePackageInfoShortHash(h)
+	if err != nil {
+		return err
+	}
+	defer traceSpan(p.Package, "package", map[string]string{
+		"host":     h.Triplet,
+		"version":  p.Version,
+		"build_id": buildID,
+	})()
+	built := false
+	finished := startBuilding(p, h)
+	defer func() { finished(built) }()
+	emit(EventBuildStart, p, h, Event{Steps: len(p.Build.Steps)})
+	defer func() {
+		if depErr, ok := err.(*DependencyError); ok {
+			emit(EventSkipped, p, h, Event{Reason: "dependency " + depErr.Failed + " failed"})
+		} else if err != nil {
+			emit(EventBuildFailed, p, h, Event{Error: err.Error()})
+		}
+	}()
+	from, err := p.resumeFrom(h)
+	if err != nil {
+		return fmt.Errorf("failed to resume build: %v", err)
+	}
+	// The log is opened first, so that it also explains failures before the
+	// first step: dependencies, sources and patches.
+	buildLog, err := openBuildLog(p, h, from != 0)
+	if err != nil {
+		return fmt.Errorf("failed to create build log: %v", err)
+	}
+	defer buildLog.Close()
+	defer func() {
+		if err != nil {
+			buildLog.Printf("build failed: %v", err)
+		}
+	}()
+	deps, err := p.HostDependencies(h)
+	if err != nil {
+		return err
+	}
+	// With -keep-going the other dependencies are still built, they may
+	// be needed by packages that do not depend on the failed one.
+	var depErr error
+	for _, dep := range deps {
+		err := dep.EnsureBuilt(ctx, h)
+		if err == nil {
+			continue
+		}
+		if depErr == nil {
+			depErr = dependencyFailed(p, dep, err)
 		}
+		if !c.KeepGoing || ctx.Err() != nil {
+			break
+		}
+	}
+	if depErr != nil {
+		return depErr
+	}
+	stats := newBuildStats(p, h)
+	stats.Resumed = from != 0
+	for _, dep := range deps {
+		if !dep.IsBuilt(h) {
+			// dep was itself resumed, so neither build is cacheable.
+			stats.Resumed = true
+		}
+	}
+	envLock, err := LockEnv(h)
+	if err != nil {
+		return err
 	}
+	defer envLock.Release()
 	envPath := h.GetEnvPath()
+	// Half extracted env is useless, the next build recreates it.
+	defer utils.OnInterrupt(func() { os.RemoveAll(envPath) })()
 	os.RemoveAll(envPath)
 	os.MkdirAll(envPath, 0755)
-	for _, dep := range deps {
-		dep.ExtractEnv(h, envPath)
+	if err := extractDependencies(deps, h, envPath); err != nil {
+		return err
 	}
-	buildPath := p.GenerateBuildPath(h, "work")
-	stagingPath := p.GenerateBuildPath(h, "staging")
-	os.RemoveAll(buildPath)
-	os.RemoveAll(stagingPath)
-	os.MkdirAll(buildPath, 0755)
-	os.MkdirAll(stagingPath, 0755)
-	defer os.RemoveAll(buildPath)
-	defer os.RemoveAll(stagingPath)
-
-	p.ExtractSource(h, buildPath)
-
-	infoPath := filepath.Join(stagingPath, h.GetEnvPath(), "usr", "share", "buildlib", p.ShortName(h)+".txt")
-	os.MkdirAll(filepath.Dir(infoPath), 0755)
-	err := os.WriteFile(infoPath, []byte(p.GeneratePackageInfo(h)), 0644)
+	buildPath, stagingPath, err := p.workPaths(h)
 	if err != nil {
-		log.Fatalf("Failed to write build info %s: %v", infoPath, err)
+		return err
 	}
+	builtPath, err := p.GenerateBuildPath(h, "built")
+	if err != nil {
+		return err
+	}
+	statsPath := builtPath + ".stats.json"
+	removeTrees := func() {
+		os.RemoveAll(buildPath)
+		os.RemoveAll(stagingPath)
+		os.RemoveAll(hostToolsPath(buildPath))
+		os.Remove(buildPath + ".failed.json")
+	}
+	keepTrees := false
+	defer func() {
+		if !keepTrees {
+			removeTrees()
+		}
+	}()
+	defer utils.OnInterrupt(removeTrees)()
 
-	for _, step := range p.Build.Steps {
-		if strings.Contains(step, ":") {
-			prefix := strings.Split(step, ":")[0]
-			if !glob.Glob(prefix, h.Triplet) && prefix != "all" {
-				continue
-			}
-			step = step[strings.Index(step, ":")+1:]
-		} else {
-			log.Fatalf("Invalid step: %s", step)
+	if from == 0 {
+		removeTrees()
+		os.MkdirAll(buildPath, 0755)
+		os.MkdirAll(stagingPath, 0755)
+
+		buildLog.Printf("preparing source in %s", buildPath)
+		if err := p.ExtractSource(ctx, h, buildPath); err != nil {
+			return err
 		}
 
-		cmd := exec.Command("sh", "-c", step)
-		cmd.Dir = buildPath
-		pathEnv := utils.GetHostPath()
-		env := p.GetEnv(h)
+		if err := p.writeStagingInfo(h, stagingPath); err != nil {
+			return err
+		}
+	} else {
+		log.Printf("[%s] Resuming build from step %d in %s, with the dependencies extracted into a fresh env", p.Package, from, buildPath)
+		buildLog.Printf("resuming from step %d", from)
+	}
 
-		cmd.Env = append(cmd.Env, []string{
-			"STAGING_DIR=" + stagingPath,
-			"HOST=" + h.Triplet,
-			"PREFIX=" + h.GetEnvPath(),
-			"PATH=" + h.GetEnvPath() + "/native/bin:" + env["PATH"] + ":" + pathEnv,
-		}...)
-		for k, v := range env {
-			cmd.Env = append(cmd.Env, k+"="+v)
+	wt, err := p.setupWorkTree(ctx, h, buildPath, stagingPath)
+	if err != nil {
+		return err
+	}
+	recordHostTools := func() {
+		if c.HostTools == "" {
+			return
+		}
+		stats.HostTools, stats.UndeclaredHostTools = p.usedHostTools(wt.toolsPath)
+		if len(stats.UndeclaredHostTools) > 0 {
+			log.Printf("[%s] Undeclared host tools used: %s", p.Package, strings.Join(stats.UndeclaredHostTools, ", "))
+		}
+	}
+	for i, step := range p.Build.Steps {
+		if i+1 < from {
+			continue
+		}
+		step, ok := matchHost(step, h)
+		if !ok {
+			continue
 		}
 
+		cmd := exec.Command("sh", "-c", step)
+
 		log.Printf("Executing step: %s", step)
-		cmd.Stderr = os.Stderr
-		cmd.Stdout = os.Stdout
-		err := cmd.Run()
+		setBuildStep(p, i+1, len(p.Build.Steps), step)
+		buildLog.Step(i+1, len(p.Build.Steps), step, wt.env)
+		output := buildLog.Output()
+		cmd.Stderr = output
+		cmd.Stdout = output
+		if err := wt.wrap(cmd); err != nil {
+			return err
+		}
+		stepEvent := Event{Step: i + 1, Steps: len(p.Build.Steps), Command: step}
+		emit(EventStepStart, p, h, stepEvent)
+		endStep := traceSpan(fmt.Sprintf("step %d", i+1), "step", map[string]string{"step": step})
+		started := time.Now()
+		err := utils.RunCommand(ctx, cmd)
+		stats.addStep(step, cmd, time.Since(started))
+		endStep()
+		stepEvent.ExitCode = exitCode(err)
 		if err != nil {
-			log.Fatalf("[%s] build step failed: %s, error: %v, %s", p.Package, step, err, cmd.Dir)
+			utils.BlockIfInterrupted()
+			stepEvent.Error = err.Error()
+			emit(EventStepFinish, p, h, stepEvent)
+			recordHostTools()
+			stats.write(statsPath)
+			buildLog.Printf("step failed: %v", err)
+			buildLog.PrintTail()
+			if c.HostTools == "enforce" && buildLog.MentionsMissingCommand() {
+				log.Printf("[%s] The step seems to have used a host tool that is not allowed, declare it in host_tools or provide it as a native dependency", p.Package)
+			}
+			if c.Sandbox && buildLog.MentionsNetwork() {
+				log.Printf("[%s] The step seems to have tried to reach the network, which is not available in the -sandbox", p.Package)
+			}
+			if c.ShellOnFailure && ctx.Err() == nil {
+				log.Printf("[%s] Step %d failed, starting a shell in its environment", p.Package, i+1)
+				wt.runShell()
+			}
+			if c.KeepFailed {
+				if err := p.writeFailedBuild(h, i+1, step); err != nil {
+					log.Printf("Failed to record failed build: %v", err)
+				}
+				// The env is shared by every build for h, so -resume extracts
+				// it again instead of relying on it.
+				log.Printf("[%s] Kept work tree %s and staging %s, and left env %s for inspection, continue with -resume", p.Package, buildPath, stagingPath, envPath)
+				keepTrees = true
+			}
+			return fmt.Errorf("[%s] build step failed: %s, error: %v, %s, log: %s", p.Package, step, err, buildPath, buildLog.path)
 		}
+		emit(EventStepFinish, p, h, stepEvent)
+		buildLog.Printf("step finished")
 	}
 
-	builtArchivePath := p.GenerateBuildPath(h, "built") + ".tar.gz"
+	builtArchivePath := builtPath + ".tar.gz"
+	infoPath := builtPath + ".info.txt"
+	removeArtifact := func() {
+		os.Remove(builtArchivePath)
+		os.Remove(infoPath)
+	}
+	unregisterArtifact := utils.OnInterrupt(removeArtifact)
+	defer unregisterArtifact()
 	os.MkdirAll(filepath.Dir(builtArchivePath), 0755)
+	// The info of a previous build must never describe the new archive.
+	os.Remove(infoPath)
+	endArchive := traceSpan("archive", "archive", nil)
 	err = utils.CreateTarGz(filepath.Join(stagingPath, h.GetEnvPath()), builtArchivePath)
+	endArchive()
 	if err != nil {
-		log.Fatalf("Failed to create archive %s: %v", builtArchivePath, err)
+		return fmt.Errorf("failed to create archive %s: %v", builtArchivePath, err)
 	}
 
-	infoPath = p.GenerateBuildPath(h, "built") + ".info.txt"
-	err = os.WriteFile(infoPath, []byte(p.GeneratePackageInfo(h)), 0644)
+	if stats.Resumed {
+		// Only a build that ran every step from a fresh tree may be cached.
+		os.Remove(infoPath)
+		log.Printf("[%s] Resumed build (or one built on a resumed dependency) is not cached, build it again without -resume to cache it", p.Package)
+	} else {
+		err = p.writeBuiltInfo(h)
+		if err != nil {
+			removeArtifact()
+			return fmt.Errorf("failed to write build info %s: %v", infoPath, err)
+		}
+	}
+	unregisterArtifact()
+	built = true
+	emit(EventArtifact, p, h, Event{Path: builtArchivePath})
+	recordHostTools()
+	err = stats.write(statsPath)
 	if err != nil {
-		log.Fatalf("Failed to write build info %s: %v", infoPath, err)
+		return fmt.Errorf("failed to write build stats: %v", err)
 	}
+	buildLog.Printf("build finished in %.1fs: %s", stats.WallSeconds, builtArchivePath)
 
 	log.Printf("Package built successfully: %s", builtArchivePath)
+	emit(EventBuildFinish, p, h, Event{Path: builtArchivePath})
+	return nil
 }
 
-func (p *Package) StartShell(h *host.Host) {
-	log.Printf("Starting shell for package: %s for host %s", p.Package, h.Triplet)
+// extractDependencies extracts the built archives of deps into envPath.
+func extractDependencies(deps []*Package, h *host.Host, envPath string) error {
+	defer traceSpan("extract env", "extract", nil)()
+	for _, dep := range deps {
+		if err := dep.ExtractEnv(h, envPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	buildPath := p.GenerateBuildPath(h, "work")
-	os.RemoveAll(buildPath)
-	os.MkdirAll(buildPath, 0755)
+// exitCode returns the exit code of a command that returned err.
+func exitCode(err error) *int {
+	code := 0
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		code = exitErr.ExitCode()
+	} else if err != nil {
+		code = -1
+	}
+	return &code
+}
 
-	log.Printf("Extracting source for package: %s", p.Package)
-	for _, depName := range p.Dependencies {
-		if strings.Contains(depName, ":") {
-			prefix := strings.Split(depName, ":")[0]
-			if !glob.Glob(prefix, h.Triplet) && prefix != "all" {
-				continue
-			}
-			depName = depName[strings.Index(depName, ":")+1:]
-		} else {
-			log.Fatalf("Invalid dependency: %s", depName)
-		}
-		dep, err := FindPackage(depName)
+// stepEnv returns the environment the build steps of p run with.
+// hostPath is the part of PATH that provides the host tools.
+func (p *Package) stepEnv(h *host.Host, stagingPath, hostPath string) []string {
+	env := p.GetEnv(h)
+	env["PATH"] = strings.Replace(env["PATH"], utils.GetHostPath(), hostPath, 1)
+
+	vars := []string{
+		"STAGING_DIR=" + stagingPath,
+		"HOST=" + h.Triplet,
+		"PREFIX=" + h.GetEnvPath(),
+		"PATH=" + h.GetEnvPath() + "/native/bin:" + env["PATH"] + ":" + hostPath,
+	}
+	for k, v := range env {
+		vars = append(vars, k+"="+v)
+	}
+	return vars
+}
+
+// workPaths returns the work tree and staging directory of p for h.
+func (p *Package) workPaths(h *host.Host) (buildPath, stagingPath string, err error) {
+	if buildPath, err = p.GenerateBuildPath(h, "work"); err != nil {
+		return "", "", err
+	}
+	stagingPath, err = p.GenerateBuildPath(h, "staging")
+	return buildPath, stagingPath, err
+}
+
+// workTree is where the build steps of a package run: the work tree itself,
+// the staging directory, the rootfs and the host tool shims.
+type workTree struct {
+	p           *Package
+	sandbox     bool
+	buildPath   string
+	stagingPath string
+	toolsPath   string
+	// root is the rootfs with -rootfs.
+	root     string
+	writable []string
+	readOnly []string
+	// env of the build steps.
+	env []string
+}
+
+// setupWorkTree sets up the rootfs and the host tool shims for running the
+// build steps of p for h in buildPath.
+func (p *Package) setupWorkTree(ctx context.Context, h *host.Host, buildPath, stagingPath string) (*workTree, error) {
+	c := p.config()
+	wt := &workTree{
+		p:           p,
+		sandbox:     c.Sandbox,
+		buildPath:   buildPath,
+		stagingPath: stagingPath,
+		toolsPath:   hostToolsPath(buildPath),
+		writable:    []string{buildPath, stagingPath, h.GetEnvPath()},
+	}
+	if c.rootfs != nil {
+		root, err := ensureRootfs(ctx, p, h)
 		if err != nil {
-			log.Fatalf("Package %s not found in build", depName)
+			return nil, fmt.Errorf("[%s] failed to set up rootfs: %v", p.Package, err)
 		}
-		dep.ExtractEnv(h, h.GetEnvPath())
+		wt.root = root
 	}
-	p.ExtractSource(h, buildPath)
+	// Steps read their patches from PATCH_DIR, which is not in the rootfs
+	// and, below /tmp, hidden by the private /tmp of the sandbox.
+	if _, err := os.Stat(getPatchDir()); err == nil {
+		wt.readOnly = append(wt.readOnly, getPatchDir())
+	}
+	hostPath := utils.GetHostPath()
+	if c.HostTools != "" {
+		if err := p.createHostToolShims(wt.toolsPath, wt.root); err != nil {
+			return nil, fmt.Errorf("[%s] failed to create host tool shims: %v", p.Package, err)
+		}
+		hostPath = wt.toolsPath
+		wt.writable = append(wt.writable, wt.toolsPath)
+	}
+	wt.env = p.stepEnv(h, stagingPath, hostPath)
+	return wt, nil
+}
 
-	env := p.GetEnv(h)
-	pathEnv := utils.GetHostPath()
+// wrap makes cmd run in the work tree with the build environment, inside the
+// sandbox when enabled. Like utils.Sandbox.Wrap it has to be called once cmd
+// is set up, cmd.Env is appended to the build environment.
+func (wt *workTree) wrap(cmd *exec.Cmd) error {
+	cmd.Dir = wt.buildPath
+	cmd.Env = append(append([]string{}, wt.env...), cmd.Env...)
+	if !wt.sandbox {
+		return nil
+	}
+	sb := utils.Sandbox{Writable: wt.writable, ReadOnly: wt.readOnly, Root: wt.root}
+	if err := sb.Wrap(cmd); err != nil {
+		return fmt.Errorf("[%s] failed to set up sandbox: %v", wt.p.Package, err)
+	}
+	return nil
+}
 
-	userShell := os.Getenv("SHELL")
-	if userShell == "" {
-		userShell = "/bin/sh"
+// writeStagingInfo writes the package info into the staging directory, where
+// it ends up in the artifact as usr/share/buildlib/<name>.txt.
+func (p *Package) writeStagingInfo(h *host.Host, stagingPath string) error {
+	name, err := p.ShortName(h)
+	if err != nil {
+		return err
 	}
+	info, err := p.GeneratePackageInfo(h)
+	if err != nil {
+		return err
+	}
+	infoPath := filepath.Join(stagingPath, h.GetEnvPath(), "usr", "share", "buildlib", name+".txt")
+	os.MkdirAll(filepath.Dir(infoPath), 0755)
+	if err := os.WriteFile(infoPath, []byte(info), 0644); err != nil {
+		return fmt.Errorf("failed to write build info %s: %v", infoPath, err)
+	}
+	return nil
+}
 
-	for _, step := range p.Build.Steps {
-		if strings.Contains(step, ":") {
-			prefix := strings.Split(step, ":")[0]
-			if !glob.Glob(prefix, h.Triplet) && prefix != "all" {
-				log.Printf("[no match] %s", step)
-				continue
-			}
-			log.Printf("   [match] %s", step)
-		} else {
-			log.Fatalf("Invalid step: %s", step)
-		}
+// runShell starts the user's shell in the work tree with the build
+// environment and waits for it. In the rootfs the shell of the rootfs is
+// used.
+func (wt *workTree) runShell() {
+	userShell := os.Getenv("SHELL")
+	if userShell == "" || wt.root != "" {
+		userShell = "/bin/sh"
 	}
-	log.Printf("Starting %s in %s with build environment for %s", userShell, buildPath, h.Triplet)
+	defer utils.Interactive()()
+	log.Printf("Starting %s in %s", userShell, wt.buildPath)
 	log.Printf("Type 'exit' to leave the shell")
 
 	cmd := exec.Command(userShell)
-	cmd.Dir = buildPath
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-
-	cmd.Env = append(cmd.Env, []string{
-		"HOST=" + h.Triplet,
-		"PREFIX=" + h.GetEnvPath(),
-		"PATH=" + h.GetEnvPath() + "/native/bin:" + env["PATH"] + ":" + pathEnv,
-		"TERM=" + os.Getenv("TERM"),
-	}...)
-
-	for k, v := range env {
-		cmd.Env = append(cmd.Env, k+"="+v)
+	cmd.Env = []string{"TERM=" + os.Getenv("TERM")}
+	if err := wt.wrap(cmd); err != nil {
+		log.Printf("Failed to start the shell: %v", err)
+		return
 	}
 
 	err := cmd.Run()
@@ -253,3 +714,121 @@ func (p *Package) StartShell(h *host.Host) {
 		log.Printf("Shell session ended successfully")
 	}
 }
+
+// StartShell prepares the work tree of p like a build does, runs the build
+// steps up to and including runSteps (numbered as in the build log, 0 runs
+// none) and starts a shell in the work tree with the environment of the
+// next step. A failing step stops there and opens the shell right away.
+// Steps and shell run in the sandbox and rootfs like a build.
+func (p *Package) StartShell(ctx context.Context, h *host.Host, runSteps int) error {
+	log.Printf("Starting shell for package: %s for host %s", p.Package, h.Triplet)
+	// Steps run in the foreground, Ctrl-C stops them and opens the shell.
+	defer utils.Interactive()()
+	l, err := LockEnv(h)
+	if err != nil {
+		return err
+	}
+	defer l.Release()
+
+	wt, err := p.prepareWorkTree(ctx, h)
+	if err != nil {
+		return err
+	}
+	for i, step := range p.Build.Steps {
+		step, ok := matchHost(step, h)
+		if !ok {
+			log.Printf("[no match] %d: %s", i+1, p.Build.Steps[i])
+			continue
+		}
+		if i+1 > runSteps {
+			log.Printf("   [match] %d: %s", i+1, step)
+			continue
+		}
+
+		log.Printf("     [run] %d: %s", i+1, step)
+		cmd := exec.CommandContext(ctx, "sh", "-c", step)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := wt.wrap(cmd); err != nil {
+			return err
+		}
+		if err := cmd.Run(); err != nil {
+			log.Printf("[%s] Step %d failed: %v", p.Package, i+1, err)
+			break
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	log.Printf("Build environment for %s", h.Triplet)
+	wt.runShell()
+	return nil
+}
+
+// Run executes args in the prepared work tree of p with the build
+// environment, in the sandbox and rootfs like a build but without running
+// any build step, and returns its exit code. err is only set when the
+// command could not be run.
+func (p *Package) Run(ctx context.Context, h *host.Host, args []string) (int, error) {
+	l, err := LockEnv(h)
+	if err != nil {
+		return 1, err
+	}
+	defer l.Release()
+	wt, err := p.prepareWorkTree(ctx, h)
+	if err != nil {
+		return 1, err
+	}
+	log.Printf("[%s] Running %s in %s", p.Package, strings.Join(args, " "), wt.buildPath)
+	defer utils.Interactive()()
+
+	// sh resolves the command using PATH of the build environment.
+	cmd := exec.CommandContext(ctx, "sh", append([]string{"-c", `exec "$@"`, "sh"}, args...)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := wt.wrap(cmd); err != nil {
+		return 1, err
+	}
+	err = cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok && ctx.Err() == nil {
+		return exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return 1, fmt.Errorf("[%s] failed to run %s: %v", p.Package, args[0], err)
+	}
+	return 0, nil
+}
+
+// prepareWorkTree extracts the dependencies of p into a fresh env and its
+// source into a fresh work tree, writes the package info into staging and
+// sets up the rootfs and host tool shims, like a build does.
+func (p *Package) prepareWorkTree(ctx context.Context, h *host.Host) (*workTree, error) {
+	deps, err := p.HostDependencies(h)
+	if err != nil {
+		return nil, err
+	}
+	buildPath, stagingPath, err := p.workPaths(h)
+	if err != nil {
+		return nil, err
+	}
+	os.RemoveAll(buildPath)
+	os.RemoveAll(stagingPath)
+	os.RemoveAll(hostToolsPath(buildPath))
+	os.MkdirAll(buildPath, 0755)
+	os.MkdirAll(stagingPath, 0755)
+
+	log.Printf("Extracting source for package: %s", p.Package)
+	os.RemoveAll(h.GetEnvPath())
+	os.MkdirAll(h.GetEnvPath(), 0755)
+	if err := extractDependencies(deps, h, h.GetEnvPath()); err != nil {
+		return nil, err
+	}
+	if err := p.ExtractSource(ctx, h, buildPath); err != nil {
+		return nil, err
+	}
+	if err := p.writeStagingInfo(h, stagingPath); err != nil {
+		return nil, err
+	}
+	return p.setupWorkTree(ctx, h, buildPath, stagingPath)
+}
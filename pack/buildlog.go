@@ -0,0 +1,158 @@
+package pack
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mrcyjanek/simplybs/host"
+)
+
+// buildLog is the full output of a single package build, stored next to the
+// artifact in built/ so that it survives failed builds as well.
+type buildLog struct {
+	path string
+	file *os.File
+	// verbose and tailLines are Options.Verbose and Options.LogTail.
+	verbose   bool
+	tailLines int
+}
+
+// LogPath returns the path of the build log of p for h.
+func (p *Package) LogPath(h *host.Host) (string, error) {
+	built, err := p.GenerateBuildPath(h, "built")
+	if err != nil {
+		return "", err
+	}
+	return built + ".log", nil
+}
+
+// openBuildLog creates the build log, or appends to it when resuming.
+func openBuildLog(p *Package, h *host.Host, appendLog bool) (*buildLog, error) {
+	path, err := p.LogPath(h)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if appendLog {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	file, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	c := p.config()
+	l := &buildLog{path: path, file: file, verbose: c.Verbose, tailLines: c.LogTail}
+	l.Printf("# %s %s for %s", p.Package, p.Version, h.Triplet)
+	return l, nil
+}
+
+// Printf writes a timestamped line to the log.
+func (l *buildLog) Printf(format string, args ...interface{}) {
+	fmt.Fprintf(l.file, "[%s] %s\n", time.Now().Format(time.RFC3339), fmt.Sprintf(format, args...))
+}
+
+// Step writes the delimiter of a build step together with the command as
+// the shell will see it after expanding env.
+func (l *buildLog) Step(index, total int, step string, env []string) {
+	values := map[string]string{}
+	for _, kv := range env {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			values[k] = v
+		}
+	}
+	resolved := os.Expand(step, func(key string) string {
+		if value, ok := values[key]; ok {
+			return value
+		}
+		return "$" + key
+	})
+	fmt.Fprintf(l.file, "\n==== step %d/%d ====\n", index, total)
+	l.Printf("$ %s", step)
+	if resolved != step {
+		l.Printf("+ %s", resolved)
+	}
+}
+
+// Output returns the writer build step output goes to.
+func (l *buildLog) Output() io.Writer {
+	if l.verbose {
+		return io.MultiWriter(l.file, os.Stdout)
+	}
+	return l.file
+}
+
+func (l *buildLog) Close() {
+	l.file.Close()
+}
+
+var networkErrors = []string{
+	"Could not resolve host",
+	"Temporary failure in name resolution",
+	"Name or service not known",
+	"Network is unreachable",
+	"nodename nor servname provided",
+	"unable to resolve host address",
+	"getaddrinfo",
+}
+
+// MentionsNetwork reports whether the tail of the log contains an error
+// typical for tools that failed to reach the network.
+func (l *buildLog) MentionsNetwork() bool {
+	for _, line := range l.tail() {
+		for _, e := range networkErrors {
+			if strings.Contains(line, e) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MentionsMissingCommand reports whether the tail of the log contains a
+// shell "command not found" error.
+func (l *buildLog) MentionsMissingCommand() bool {
+	for _, line := range l.tail() {
+		if strings.Contains(line, "command not found") || strings.HasSuffix(line, ": not found") {
+			return true
+		}
+	}
+	return false
+}
+
+// PrintTail logs the last lines of the build log.
+func (l *buildLog) PrintTail() {
+	lines := l.tail()
+	log.Printf("Last %d lines of %s:", len(lines), l.path)
+	for _, line := range lines {
+		fmt.Fprintln(os.Stderr, line)
+	}
+}
+
+// tail returns the last tailLines lines of the log.
+func (l *buildLog) tail() []string {
+	file, err := os.Open(l.path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+		if len(lines) > l.tailLines {
+			lines = lines[1:]
+		}
+	}
+	return lines
+}
@@ -0,0 +1,92 @@
+package pack
+
+import (
+	"context"
+	"time"
+
+	"github.com/mrcyjanek/simplybs/host"
+	"github.com/mrcyjanek/simplybs/utils"
+)
+
+// EventKind says what an Event is about.
+type EventKind string
+
+// The event kinds, their names are part of the -json output and never
+// change.
+const (
+	EventResolve          EventKind = "resolve"
+	EventDownloadStart    EventKind = "download_start"
+	EventDownloadProgress EventKind = "download_progress"
+	EventDownloadFinish   EventKind = "download_finish"
+	EventCacheHit         EventKind = "cache_hit"
+	EventCacheMiss        EventKind = "cache_miss"
+	EventBuildStart       EventKind = "build_start"
+	EventStepStart        EventKind = "step_start"
+	EventStepFinish       EventKind = "step_finish"
+	EventArtifact         EventKind = "artifact"
+	EventBuildFinish      EventKind = "build_finish"
+	EventBuildFailed      EventKind = "build_failed"
+	EventSkipped          EventKind = "skipped"
+	EventExtract          EventKind = "extract"
+	EventInterrupted      EventKind = "interrupted"
+	// EventResult is the kind of the Result closing the -json output.
+	EventResult EventKind = "result"
+)
+
+// Event is emitted to the callback in Options.Events as a session makes
+// progress. Fields that do not apply to the kind are left empty.
+type Event struct {
+	Time    time.Time `json:"time"`
+	Kind    EventKind `json:"kind"`
+	Package string    `json:"package,omitempty"`
+	Host    string    `json:"host,omitempty"`
+	// Step is numbered as in the build log, Steps is their total.
+	Step    int    `json:"step,omitempty"`
+	Steps   int    `json:"steps,omitempty"`
+	Command string `json:"command,omitempty"`
+	// ExitCode of a finished step, -1 when it was killed or did not start.
+	ExitCode *int `json:"exit_code,omitempty"`
+	// Dependencies of the package in build order, when resolving.
+	Dependencies []string `json:"dependencies,omitempty"`
+	// Bytes downloaded so far out of Total, which is 0 when unknown.
+	Bytes int64 `json:"bytes,omitempty"`
+	Total int64 `json:"total,omitempty"`
+	// Reason why the cache was missed or the package was skipped.
+	Reason string `json:"reason,omitempty"`
+	// Path of the artifact, the extracted env or the downloaded source.
+	Path  string `json:"path,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// emit passes e to the event handler of the session p was loaded by.
+func emit(kind EventKind, p *Package, h *host.Host, e Event) {
+	p.config().emit(kind, p, h, e)
+}
+
+// emit passes e to Options.Events, filling in the time, package and host.
+func (c *config) emit(kind EventKind, p *Package, h *host.Host, e Event) {
+	if c.Events == nil {
+		return
+	}
+	c.events.Lock()
+	defer c.events.Unlock()
+	e.Time = time.Now()
+	e.Kind = kind
+	if p != nil {
+		e.Package = p.Package
+	}
+	if h != nil {
+		e.Host = h.Triplet
+	}
+	c.Events(e)
+}
+
+// withProgress reports the download progress of p in ctx as events.
+func (p *Package) withProgress(ctx context.Context) context.Context {
+	if p.config().Events == nil {
+		return ctx
+	}
+	return utils.WithProgress(ctx, func(path string, written, total int64) {
+		emit(EventDownloadProgress, p, nil, Event{Path: path, Bytes: written, Total: total})
+	})
+}
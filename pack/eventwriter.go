@@ -0,0 +1,92 @@
+package pack
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Result closes the -json output, listing what happened to every package
+// built in the session.
+type Result struct {
+	Time     time.Time       `json:"time"`
+	Kind     EventKind       `json:"kind"` // always "result"
+	Success  bool            `json:"success"`
+	ExitCode int             `json:"exit_code"`
+	Error    string          `json:"error,omitempty"`
+	Built    []ResultPackage `json:"built"`
+	Cached   []ResultPackage `json:"cached"`
+	Failed   []ResultPackage `json:"failed"`
+	Skipped  []ResultPackage `json:"skipped"`
+}
+
+type ResultPackage struct {
+	Package string `json:"package"`
+	Host    string `json:"host"`
+	// Path of the artifact, or Error for failed packages and why skipped
+	// packages were skipped.
+	Path  string `json:"path,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// EventWriter writes events as newline-delimited JSON, to be used as
+// Options.Events, and the Result when the session finishes.
+type EventWriter struct {
+	mu       sync.Mutex
+	enc      *json.Encoder
+	summary  *Summary
+	finished bool
+}
+
+func NewEventWriter(w io.Writer) *EventWriter {
+	return &EventWriter{enc: json.NewEncoder(w), summary: NewSummary()}
+}
+
+// Handle writes e and records its outcome for the Result.
+func (w *EventWriter) Handle(e Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.finished {
+		return
+	}
+	w.enc.Encode(e)
+	w.summary.Handle(e)
+	if e.Kind == EventInterrupted {
+		code := 1
+		if e.ExitCode != nil {
+			code = *e.ExitCode
+		}
+		w.finish(code, e.Error)
+	}
+}
+
+// Finish writes the Result for a session ending with exitCode, err says
+// why it failed. Only the first call has an effect.
+func (w *EventWriter) Finish(exitCode int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	msg := ""
+	if err != nil {
+		msg = err.Error()
+	}
+	w.finish(exitCode, msg)
+}
+
+func (w *EventWriter) finish(exitCode int, err string) {
+	if w.finished {
+		return
+	}
+	w.finished = true
+	w.enc.Encode(Result{
+		Time:     time.Now(),
+		Kind:     EventResult,
+		Success:  exitCode == 0,
+		ExitCode: exitCode,
+		Error:    err,
+		Built:    w.summary.Packages(OutcomeBuilt),
+		Cached:   w.summary.Packages(OutcomeCached),
+		Failed:   w.summary.Packages(OutcomeFailed),
+		Skipped:  w.summary.Packages(OutcomeSkipped),
+	})
+}
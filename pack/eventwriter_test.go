@@ -0,0 +1,124 @@
+package pack
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// decodeLines decodes every line of the newline-delimited JSON in buf.
+func decodeLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		var line map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("invalid line %q: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestEventWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewEventWriter(&buf)
+	zero := 0
+	w.Handle(Event{Kind: EventStepFinish, Package: "zlib", Host: "x86_64-linux-gnu", Step: 1, Steps: 2, Command: "make", ExitCode: &zero})
+	w.Handle(Event{Kind: EventArtifact, Package: "zlib", Host: "x86_64-linux-gnu", Path: "zlib.tar.gz"})
+	w.Handle(Event{Kind: EventCacheHit, Package: "native/make", Host: "x86_64-linux-gnu", Path: "make.tar.gz"})
+	w.Handle(Event{Kind: EventBuildFailed, Package: "curl", Host: "x86_64-linux-gnu", Error: "step failed"})
+	w.Handle(Event{Kind: EventSkipped, Package: "git", Host: "x86_64-linux-gnu", Reason: "dependency curl failed"})
+	w.Finish(1, errors.New("2 packages failed"))
+	// Only the first result is written, nothing after it.
+	w.Finish(0, nil)
+	w.Handle(Event{Kind: EventArtifact, Package: "late", Host: "x86_64-linux-gnu"})
+
+	raw := buf.String()
+	lines := decodeLines(t, &buf)
+	if len(lines) != 6 {
+		t.Fatalf("got %d lines, want 6:\n%s", len(lines), raw)
+	}
+
+	step := lines[0]
+	if step["kind"] != "step_finish" || step["package"] != "zlib" || step["command"] != "make" || step["step"] != 1.0 {
+		t.Errorf("unexpected step event %v", step)
+	}
+	// A successful step reports exit code 0, unset fields are left out.
+	if code, ok := step["exit_code"]; !ok || code != 0.0 {
+		t.Errorf("exit_code of the successful step is %v", code)
+	}
+	for _, field := range []string{"error", "path", "reason", "dependencies", "bytes", "total"} {
+		if _, ok := step[field]; ok {
+			t.Errorf("empty field %s written: %v", field, step)
+		}
+	}
+	if _, ok := lines[1]["exit_code"]; ok {
+		t.Errorf("exit_code written for an artifact event: %v", lines[1])
+	}
+	if _, ok := step["time"].(string); !ok {
+		t.Errorf("time missing: %v", step)
+	}
+
+	result := lines[5]
+	if result["kind"] != "result" || result["success"] != false || result["exit_code"] != 1.0 || result["error"] != "2 packages failed" {
+		t.Fatalf("unexpected result %v", result)
+	}
+	want := map[string]string{"built": "zlib", "cached": "native/make", "failed": "curl", "skipped": "git"}
+	for outcome, pkg := range want {
+		list, ok := result[outcome].([]interface{})
+		if !ok || len(list) != 1 || list[0].(map[string]interface{})["package"] != pkg {
+			t.Errorf("result %s is %v, want %s", outcome, result[outcome], pkg)
+		}
+	}
+	if !strings.Contains(raw, `"skipped":[{"package":"git","host":"x86_64-linux-gnu","error":"dependency curl failed"}]`) {
+		t.Errorf("skip reason not in the result:\n%s", raw)
+	}
+}
+
+func TestEventWriterEmptyResult(t *testing.T) {
+	var buf bytes.Buffer
+	NewEventWriter(&buf).Finish(0, nil)
+	if got := strings.TrimSpace(buf.String()); !strings.Contains(got, `"success":true,"exit_code":0,"built":[],"cached":[],"failed":[],"skipped":[]}`) {
+		t.Errorf("empty result is %s, want empty lists", got)
+	}
+}
+
+func TestEventWriterInterrupted(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewEventWriter(&buf)
+	code := 130
+	w.Handle(Event{Kind: EventInterrupted, ExitCode: &code, Error: "interrupted (interrupt)"})
+	w.Finish(1, errors.New("not written"))
+
+	lines := decodeLines(t, &buf)
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want the event and the result", len(lines))
+	}
+	if _, ok := lines[0]["package"]; ok || lines[0]["kind"] != "interrupted" {
+		t.Errorf("unexpected interrupted event %v", lines[0])
+	}
+	result := lines[1]
+	if result["kind"] != "result" || result["exit_code"] != 130.0 || result["error"] != "interrupted (interrupt)" {
+		t.Errorf("interrupted session closed with %v", result)
+	}
+}
+
+// TestEventWriterInterruptedWithoutCode closes the session with exit code 1
+// when the interrupted event carries none.
+func TestEventWriterInterruptedWithoutCode(t *testing.T) {
+	var buf bytes.Buffer
+	NewEventWriter(&buf).Handle(Event{Kind: EventInterrupted, Error: "interrupted"})
+
+	lines := decodeLines(t, &buf)
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want the event and the result", len(lines))
+	}
+	if result := lines[1]; result["kind"] != "result" || result["exit_code"] != 1.0 || result["error"] != "interrupted" {
+		t.Errorf("interrupted session closed with %v", result)
+	}
+}
@@ -0,0 +1,245 @@
+package pack
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mrcyjanek/simplybs/host"
+	"github.com/mrcyjanek/simplybs/utils"
+)
+
+// fsck collects the problems found in .buildlib and removes the broken
+// entries when repairing.
+type fsck struct {
+	repair   bool
+	problems int
+}
+
+func (f *fsck) problem(format string, args ...interface{}) {
+	f.problems++
+	log.Printf("fsck: "+format, args...)
+}
+
+// remove deletes paths when repairing.
+func (f *fsck) remove(paths ...string) {
+	if !f.repair {
+		return
+	}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("fsck: failed to remove %s: %v", path, err)
+			continue
+		}
+		log.Printf("fsck: removed %s", path)
+	}
+}
+
+// removeAll deletes the directory at path when repairing.
+func (f *fsck) removeAll(path string) {
+	if !f.repair {
+		return
+	}
+	if err := os.RemoveAll(path); err != nil {
+		log.Printf("fsck: failed to remove %s: %v", path, err)
+		return
+	}
+	log.Printf("fsck: removed %s", path)
+}
+
+// Fsck runs git fsck on the git mirrors, verifies cached sources against the
+// sha256 of their packages (git exports without one against their tree hash
+// or a fresh export of the commit) and built archives against the sha256
+// recorded in their .info.txt, and reports archives or info files missing
+// their other half. With repair the broken entries are deleted, so that the
+// next build downloads or rebuilds them. It returns the number of problems
+// found.
+func Fsck(repair bool) (int, error) {
+	f := &fsck{repair: repair}
+	mirrors := f.checkGitMirrors()
+	sources, err := f.checkSources()
+	if err != nil {
+		return 0, err
+	}
+	archives := f.checkBuilt()
+	log.Printf("fsck: checked %d git mirrors, %d sources and %d archives, %d problems found", mirrors, sources, archives, f.problems)
+	if f.problems > 0 && !repair {
+		log.Printf("fsck: run with -fsck-repair to delete the broken entries")
+	}
+	return f.problems, nil
+}
+
+func (f *fsck) checkSources() (int, error) {
+	packages, err := GetAllPackages()
+	if err != nil {
+		return 0, err
+	}
+	checked := 0
+	seen := map[string]bool{}
+	for _, pkg := range packages {
+		if pkg.Download.Kind == "none" || (pkg.Download.Sha256 == "" && pkg.Download.Kind != "git") {
+			continue
+		}
+		path := pkg.SourcePath()
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		checked++
+		if pkg.Download.Sha256 == "" {
+			f.checkGitSource(pkg, path)
+			continue
+		}
+		sum, err := utils.FileSha256(path)
+		if err != nil {
+			f.problem("source %s of %s is unreadable: %v", path, pkg.Package, err)
+			f.remove(path)
+			continue
+		}
+		if sum != pkg.Download.Sha256 {
+			f.problem("source %s of %s has sha256 %s, expected %s", path, pkg.Package, sum, pkg.Download.Sha256)
+			f.remove(path)
+		}
+	}
+	return checked, nil
+}
+
+// checkGitSource verifies the export of a git source without a pinned
+// sha256 against its tree hash or, without one, a fresh export of the
+// commit from the git mirror.
+func (f *fsck) checkGitSource(pkg *Package, path string) {
+	src := pkg.GitSource()
+	if src.Tree != "" {
+		if err := utils.VerifyGitTarball(src, path); err != nil {
+			f.problem("source %s of %s does not match its tree: %v", path, pkg.Package, err)
+			f.remove(path)
+		}
+		return
+	}
+	// The source mirror index is not trusted without a pinned sha256 or
+	// tree, only the commit in the git mirror is.
+	if !utils.GitSourceCached(src) {
+		log.Printf("fsck: source %s of %s has no sha256 or tree and its commit is not in a git mirror, not verified", path, pkg.Package)
+		return
+	}
+	export := path + ".fsck"
+	defer os.Remove(export)
+	expected, _, err := utils.CreateGitTarball(pkg.Package, src, export)
+	if err != nil {
+		f.problem("failed to export %s from its git mirror to verify %s: %v", pkg.Package, path, err)
+		return
+	}
+	sum, err := utils.FileSha256(path)
+	if err != nil || sum != expected {
+		f.problem("source %s of %s has sha256 %s, expected %s", path, pkg.Package, sum, expected)
+		f.remove(path)
+	}
+}
+
+// checkGitMirrors runs git fsck on the bare git mirrors. A broken mirror is
+// removed as a whole and fetched again by the next download.
+func (f *fsck) checkGitMirrors() int {
+	mirrors, _ := filepath.Glob(filepath.Join(utils.GitMirrorsDir(), "*.git"))
+	if len(mirrors) == 0 {
+		return 0
+	}
+	if _, err := exec.LookPath("git"); err != nil {
+		log.Printf("fsck: git not found, the git mirrors in %s are not verified", utils.GitMirrorsDir())
+		return 0
+	}
+	for _, mirror := range mirrors {
+		out, err := exec.Command("git", "--git-dir", mirror, "fsck", "--no-progress", "--no-dangling").CombinedOutput()
+		if err != nil {
+			f.problem("git mirror %s is broken: %v\n%s", mirror, err, strings.TrimSpace(string(out)))
+			f.removeAll(mirror)
+		}
+	}
+	return len(mirrors)
+}
+
+// checkBuilt verifies the built directories of every builder.
+func (f *fsck) checkBuilt() int {
+	builtDirs, _ := filepath.Glob(filepath.Join(host.DataDirRoot(), "*", "built"))
+	archives := map[string]bool{}
+	infos := map[string]bool{}
+	for _, dir := range builtDirs {
+		filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return nil
+			}
+			switch {
+			case strings.HasSuffix(path, ".tmp"):
+				f.problem("leftover temporary file %s", path)
+				f.remove(path)
+			case strings.HasSuffix(path, ".tar.gz"):
+				archives[strings.TrimSuffix(path, ".tar.gz")] = true
+			case strings.HasSuffix(path, ".info.txt"):
+				infos[strings.TrimSuffix(path, ".info.txt")] = true
+			}
+			return nil
+		})
+	}
+
+	names := make([]string, 0, len(archives))
+	for name := range archives {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		archive, info := name+".tar.gz", name+".info.txt"
+		if !infos[name] {
+			// Resumed builds never get an .info.txt, they are rebuilt by
+			// the next regular build.
+			if stats, err := ReadBuildStats(name + ".stats.json"); err == nil && stats.Resumed {
+				if err := utils.VerifyTarGz(archive); err != nil {
+					f.problem("%s is unreadable: %v", archive, err)
+					f.remove(archive)
+				}
+				continue
+			}
+			f.problem("%s has no .info.txt (interrupted build)", archive)
+			f.remove(archive)
+			continue
+		}
+		if err := utils.VerifyTarGz(archive); err != nil {
+			f.problem("%s is unreadable: %v", archive, err)
+			f.remove(archive, info)
+			continue
+		}
+		_, expected, err := readBuiltInfo(info)
+		if err != nil {
+			f.problem("%s is unreadable: %v", info, err)
+			f.remove(archive, info)
+			continue
+		}
+		if expected == "" {
+			f.problem("%s records no archive sha256", info)
+			f.remove(archive, info)
+			continue
+		}
+		sum, err := utils.FileSha256(archive)
+		if err != nil || sum != expected {
+			f.problem("%s does not match the sha256 recorded in %s", archive, info)
+			f.remove(archive, info)
+		}
+	}
+	var orphans []string
+	for name := range infos {
+		if !archives[name] {
+			orphans = append(orphans, name+".info.txt")
+		}
+	}
+	sort.Strings(orphans)
+	for _, info := range orphans {
+		f.problem("%s has no archive", info)
+		f.remove(info)
+	}
+	return len(names)
+}
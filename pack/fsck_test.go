@@ -0,0 +1,136 @@
+package pack
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mrcyjanek/simplybs/host"
+	"github.com/mrcyjanek/simplybs/utils"
+)
+
+// writeGitPackage writes a git package pinned to commit and tree and
+// returns the path of its source export.
+func writeGitPackage(t *testing.T, packagesDir, name, commit, tree string) string {
+	t.Helper()
+	pkg := map[string]interface{}{
+		"package":  name,
+		"version":  "1",
+		"download": map[string]string{"kind": "git", "url": "file:///nonexistent/" + name + ".git", "commit": commit, "tree": tree},
+	}
+	content, err := json.Marshal(pkg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(packagesDir, name+".json"), string(content), 0644)
+	p, err := FindPackage(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.SourcePath()
+}
+
+func TestFsck(t *testing.T) {
+	packagesDir := t.TempDir()
+	t.Setenv("SIMPLYBS_PACKAGES_DIR", packagesDir)
+	t.Setenv("SIMPLYBS_DATA_DIR", t.TempDir())
+	t.Setenv("SIMPLYBS_MIRROR", "file://"+t.TempDir())
+
+	// Git exports without a sha256 are verified against their tree.
+	export := t.TempDir()
+	writeTestFile(t, filepath.Join(export, "README"), "hello\n", 0644)
+	tree, err := utils.HashTree(export)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := writeGitPackage(t, packagesDir, "good", strings.Repeat("1", 40), tree)
+	bad := writeGitPackage(t, packagesDir, "bad", strings.Repeat("2", 40), tree)
+	unpinned := writeGitPackage(t, packagesDir, "unpinned", strings.Repeat("3", 40), "")
+	os.MkdirAll(filepath.Dir(good), 0755)
+	for _, path := range []string{good, unpinned} {
+		if _, err := utils.CreateDeterministicTar(export, path, "export"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestFile(t, filepath.Join(export, "README"), "tampered\n", 0644)
+	if _, err := utils.CreateDeterministicTar(export, bad, "export"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A resumed build has no .info.txt but is kept, an interrupted one is
+	// removed.
+	built := filepath.Join(host.DataDir(), "built", "x86_64-linux-gnu")
+	resumed := filepath.Join(built, "resumed-1-00000000")
+	interrupted := filepath.Join(built, "interrupted-1-00000000")
+	createTestArchive(t, resumed+".tar.gz", map[string]string{"native/bin/tool": "tool\n"})
+	createTestArchive(t, interrupted+".tar.gz", map[string]string{"native/bin/tool": "tool\n"})
+	if err := (&BuildStats{Package: "resumed", Resumed: true}).write(resumed + ".stats.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	wantProblems := 2
+	var brokenMirror string
+	if _, err := exec.LookPath("git"); err == nil {
+		brokenMirror = createBrokenGitMirror(t)
+		wantProblems++
+	}
+
+	problems, err := Fsck(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems != wantProblems {
+		t.Errorf("found %d problems, want %d", problems, wantProblems)
+	}
+	if _, err := os.Stat(bad); err != nil {
+		t.Errorf("fsck without repair removed %s", bad)
+	}
+
+	if _, err := Fsck(true); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{good, unpinned, resumed + ".tar.gz"} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("intact %s was removed", path)
+		}
+	}
+	for _, path := range []string{bad, interrupted + ".tar.gz", brokenMirror} {
+		if _, err := os.Stat(path); path != "" && err == nil {
+			t.Errorf("broken %s was not removed", path)
+		}
+	}
+	if problems, err := Fsck(false); err != nil || problems != 0 {
+		t.Errorf("fsck after repair found %d problems: %v", problems, err)
+	}
+}
+
+// createBrokenGitMirror creates a bare git mirror with a corrupt object.
+func createBrokenGitMirror(t *testing.T) string {
+	t.Helper()
+	work := t.TempDir()
+	mirror := filepath.Join(utils.GitMirrorsDir(), "broken-00000000.git")
+	git := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.org", "GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.org")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	writeTestFile(t, filepath.Join(work, "file"), "content\n", 0644)
+	git("-C", work, "init", "-q")
+	git("-C", work, "add", "file")
+	git("-C", work, "commit", "-q", "-m", "initial")
+	git("clone", "-q", "--bare", work, mirror)
+	blob := git("-C", work, "rev-parse", "HEAD:file")
+	object := filepath.Join(mirror, "objects", blob[:2], blob[2:])
+	os.Chmod(object, 0644)
+	if err := os.WriteFile(object, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return mirror
+}
@@ -0,0 +1,98 @@
+package pack
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mrcyjanek/simplybs/utils"
+)
+
+// defaultHostTools may be used from the host by every package without
+// declaring them in host_tools.
+var defaultHostTools = []string{
+	"[", "awk", "basename", "cat", "chmod", "cmp", "cp", "cut", "date",
+	"diff", "dirname", "echo", "env", "expr", "false", "find", "grep",
+	"head", "install", "ln", "ls", "mkdir", "mktemp", "mv", "od", "printf",
+	"pwd", "rm", "rmdir", "sed", "sh", "sleep", "sort", "tail", "tee",
+	"test", "touch", "tr", "true", "uname", "uniq", "wc", "xargs",
+}
+
+// hostToolsPath returns the shim directory of p, next to its work tree.
+func hostToolsPath(buildPath string) string {
+	return buildPath + ".hosttools"
+}
+
+// allowedHostTools returns the host tools p may use.
+func (p *Package) allowedHostTools() map[string]bool {
+	allowed := map[string]bool{}
+	for _, tool := range defaultHostTools {
+		allowed[tool] = true
+	}
+	for _, tool := range p.HostTools {
+		allowed[tool] = true
+	}
+	return allowed
+}
+
+// createHostToolShims fills dir with a shim for every host tool found in
+// the host PATH below root ("" for the host itself), or only for the
+// allowed ones when enforcing. Each shim logs its name to used.txt and
+// executes the real tool.
+func (p *Package) createHostToolShims(dir, root string) error {
+	os.RemoveAll(dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	enforce := p.config().HostTools == "enforce"
+	allowed := p.allowedHostTools()
+	usedPath := filepath.Join(dir, "used.txt")
+	seen := map[string]bool{}
+	for _, binDir := range strings.Split(utils.GetHostPath(), ":") {
+		entries, err := os.ReadDir(filepath.Join(root, binDir))
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if seen[name] || entry.IsDir() || strings.ContainsAny(name, "'\n") {
+				continue
+			}
+			if enforce && !allowed[name] {
+				continue
+			}
+			seen[name] = true
+			shim := fmt.Sprintf("#!/bin/sh\necho '%s' >> '%s'\nexec '%s' \"$@\"\n", name, usedPath, filepath.Join(binDir, name))
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(shim), 0755); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// usedHostTools returns the host tools recorded by the shims in dir and
+// those of them p did not declare.
+func (p *Package) usedHostTools(dir string) (used, undeclared []string) {
+	content, err := os.ReadFile(filepath.Join(dir, "used.txt"))
+	if err != nil {
+		return nil, nil
+	}
+	allowed := p.allowedHostTools()
+	seen := map[string]bool{}
+	for _, name := range strings.Split(string(content), "\n") {
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		used = append(used, name)
+		if !allowed[name] {
+			undeclared = append(undeclared, name)
+		}
+	}
+	sort.Strings(used)
+	sort.Strings(undeclared)
+	return used, undeclared
+}
@@ -4,7 +4,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
-	"log"
+	"fmt"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -12,58 +12,99 @@ import (
 	"strings"
 
 	"github.com/mrcyjanek/simplybs/builder"
-	"github.com/mrcyjanek/simplybs/crash"
 	"github.com/mrcyjanek/simplybs/host"
 	"github.com/mrcyjanek/simplybs/utils"
 )
 
-func (p *Package) GeneratePackageInfo(h *host.Host) string {
+// infoView strips the fields that do not affect the build output, and any
+// credentials embedded in the download URL.
+func (p *Package) infoView() *Package {
+	view := *p
+	view.Upstream = nil
+	view.Download.Signature = nil
+	view.Download.URL = utils.RedactURL(view.Download.URL)
+	return &view
+}
+
+// GeneratePackageInfo describes everything that goes into the build of p for
+// h, the build cache is only used when it matches.
+func (p *Package) GeneratePackageInfo(h *host.Host) (string, error) {
+	c := p.config()
 	pkgs := map[string]interface{}{}
-	pkgs["_target"] = p
+	pkgs["_target"] = p.infoView()
 	for _, dep := range p.Dependencies {
 		if strings.Contains(dep, ":") {
 			dep = dep[strings.Index(dep, ":")+1:]
 		}
-		pkg, err := FindPackage(dep)
+		pkg, err := c.find(dep)
 		if err != nil {
-			log.Fatalf("Package %s not found in info", dep)
+			// Building fails when resolving the dependency, for other
+			// hosts the missing package is recorded as null.
+			pkgs[dep] = nil
+			continue
 		}
-		pkgs[dep] = pkg
+		pkgs[dep] = pkg.infoView()
 	}
 	env := p.GetEnvForLogs(h)
 	delete(env, "PATH")
 	pkgs["_env"] = env
+	if rootfs := c.rootfsInfo(); rootfs != nil {
+		pkgs["_rootfs"] = rootfs
+	}
+	if c.HostTools != "" {
+		pkgs["_host_tools"] = c.HostTools
+	}
 	info, err := json.MarshalIndent(pkgs, "", "  ")
-	crash.Handle(err)
-	return string(info)
+	if err != nil {
+		return "", fmt.Errorf("[%s] failed to generate package info: %v", p.Package, err)
+	}
+	return string(info), nil
 }
 
-func (p *Package) GeneratePackageInfoHash(h *host.Host) string {
-	info := p.GeneratePackageInfo(h)
+func (p *Package) GeneratePackageInfoHash(h *host.Host) (string, error) {
+	info, err := p.GeneratePackageInfo(h)
+	if err != nil {
+		return "", err
+	}
 	hash := sha256.Sum256([]byte(info))
-	return hex.EncodeToString(hash[:])
+	return hex.EncodeToString(hash[:]), nil
+}
+
+func (p *Package) GeneratePackageInfoShortHash(h *host.Host) (string, error) {
+	hash, err := p.GeneratePackageInfoHash(h)
+	if err != nil {
+		return "", err
+	}
+	return hash[:8], nil
 }
 
-func (p *Package) GeneratePackageInfoShortHash(h *host.Host) string {
-	hash := p.GeneratePackageInfoHash(h)
-	return hash[:8]
+func (p *Package) ShortName(h *host.Host) (string, error) {
+	hash, err := p.GeneratePackageInfoShortHash(h)
+	if err != nil {
+		return "", err
+	}
+	return p.Package + "-" + p.Version + "-" + hash, nil
 }
 
-func (p *Package) ShortName(h *host.Host) string {
-	return p.Package + "-" + p.Version + "-" + p.GeneratePackageInfoShortHash(h)
+// SourcePath returns where the source of p is cached, it is shared by every
+// host.
+func (p *Package) SourcePath() string {
+	name := filepath.Base(p.Download.URL)
+	if p.Download.Kind == "git" {
+		name = utils.GitTarballName(p.GitSource())
+	}
+	return filepath.Join(host.DataDir(), "..", "source", name)
 }
 
-func (p *Package) GenerateBuildPath(h *host.Host, kind string) string {
+func (p *Package) GenerateBuildPath(h *host.Host, kind string) (string, error) {
 	if kind == "source" {
-		var name string
-		if p.Download.Kind == "git" {
-			name = filepath.Base(p.Download.URL) + "-" + p.Download.Sha256[0:8] + ".git"
-		} else {
-			name = filepath.Base(p.Download.URL)
-		}
-		return filepath.Join(host.DataDir(), "..", kind, name)
+		return p.SourcePath(), nil
+	}
+	name, err := p.ShortName(h)
+	if err != nil {
+		return "", err
 	}
-	return filepath.Join(host.DataDir(), kind, h.Triplet, p.ShortName(h))
+	return filepath.Join(host.DataDir(), kind, h.Triplet, name), nil
 }
 
 func getNumCores() int {
@@ -74,9 +115,12 @@ func getNumCores() int {
 	return cores
 }
 
+func getPatchDir() string {
+	getwd, _ := os.Getwd()
+	return filepath.Join(getwd, "patches")
+}
+
 func (p *Package) GetEnv(h *host.Host) map[string]string {
-	getwd, err := os.Getwd()
-	crash.Handle(err)
 	env := map[string]string{
 		"PATH":        h.GetEnvPath() + "/native/bin:" + utils.GetHostPath(),
 		"HOST":        h.Triplet,
@@ -84,7 +128,7 @@ func (p *Package) GetEnv(h *host.Host) map[string]string {
 		"HOME":        h.GetEnvPath() + "/home/user",
 		"HOST_PREFIX": h.GetEnvPath(),
 		"NUM_CORES":   strconv.Itoa(runtime.NumCPU()),
-		"PATCH_DIR":   filepath.Join(getwd, "patches"),
+		"PATCH_DIR":   getPatchDir(),
 	}
 
 	env = utils.AppendEnv(env, builder.HostBuilder.GlobalEnv, h)
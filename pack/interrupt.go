@@ -0,0 +1,70 @@
+package pack
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/mrcyjanek/simplybs/host"
+	"github.com/mrcyjanek/simplybs/utils"
+)
+
+// HandleInterrupts stops running build steps, removes the trees of the
+// interrupted builds and prints a summary of the session on SIGINT and
+// SIGTERM.
+func (s *Session) HandleInterrupts() {
+	utils.HandleInterrupts(s.cfg.printInterruptSummary)
+}
+
+// startBuilding records that p is being built and returns the function
+// recording that it finished.
+func startBuilding(p *Package, h *host.Host) func(built bool) {
+	progress := &p.config().progress
+	name := p.Package + " for " + h.Triplet
+	progress.Lock()
+	progress.building = append(progress.building, name)
+	progress.step = ""
+	progress.Unlock()
+	return func(built bool) {
+		progress.Lock()
+		defer progress.Unlock()
+		progress.building = progress.building[:len(progress.building)-1]
+		progress.step = ""
+		if built {
+			progress.built = append(progress.built, name)
+		}
+	}
+}
+
+func setBuildStep(p *Package, index, total int, step string) {
+	progress := &p.config().progress
+	progress.Lock()
+	progress.step = fmt.Sprintf("step %d/%d: %s", index, total, step)
+	progress.Unlock()
+}
+
+func (c *config) printInterruptSummary(sig os.Signal) {
+	progress := &c.progress
+	progress.Lock()
+	defer progress.Unlock()
+	if len(progress.building) == 0 {
+		log.Printf("Interrupted (%v)", sig)
+	} else {
+		current := progress.building[len(progress.building)-1]
+		if progress.step != "" {
+			current += " (" + progress.step + ")"
+		}
+		log.Printf("Interrupted while building %s", current)
+		for i := len(progress.building) - 2; i >= 0; i-- {
+			log.Printf("  needed by %s", progress.building[i])
+		}
+		log.Printf("Removed their work trees, staging directories and env, no artifact was written")
+	}
+	if len(progress.built) > 0 {
+		log.Printf("Built before the interruption: %s", strings.Join(progress.built, ", "))
+	}
+	code := utils.SignalExitCode(sig)
+	c.emit(EventInterrupted, nil, nil, Event{ExitCode: &code, Error: fmt.Sprintf("interrupted (%v)", sig)})
+	StopTrace()
+}
@@ -0,0 +1,50 @@
+package pack
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/mrcyjanek/simplybs/host"
+	"github.com/mrcyjanek/simplybs/utils"
+)
+
+// Locks taken by simplybs, all in utils.LocksDir():
+//
+//	datadir            shared by every run, exclusive for -cleanup and repairs
+//	source-<file>      while a source is downloaded
+//	build-<host>-<id>  while a package is built
+//	env-<host>         while the env of a host is in use
+//	git-<mirror>       while a git mirror is fetched
+//	rootfs-<name>      while a rootfs is assembled
+func lock(name string, exclusive bool) (*utils.Lock, error) {
+	l, err := utils.AcquireLock(name, exclusive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to take lock %s: %v", name, err)
+	}
+	return l, nil
+}
+
+// LockDataDir is held for the whole run. Commands deleting from the data
+// dir take it exclusively, so they wait for all other runs and the other
+// way round.
+func LockDataDir(exclusive bool) (*utils.Lock, error) {
+	return lock("datadir", exclusive)
+}
+
+// LockEnv reserves the env of h, which every build for h extracts its
+// dependencies into.
+func LockEnv(h *host.Host) (*utils.Lock, error) {
+	return lock("env-"+h.Triplet, true)
+}
+
+func (p *Package) lockBuild(h *host.Host) (*utils.Lock, error) {
+	name, err := p.ShortName(h)
+	if err != nil {
+		return nil, err
+	}
+	return lock("build-"+h.Triplet+"-"+name, true)
+}
+
+func lockSource(sourcePath string) (*utils.Lock, error) {
+	return lock("source-"+filepath.Base(sourcePath), true)
+}
@@ -9,8 +9,8 @@ import (
 	"strings"
 
 	"github.com/mrcyjanek/simplybs/builder"
-	"github.com/mrcyjanek/simplybs/crash"
 	"github.com/mrcyjanek/simplybs/host"
+	"github.com/mrcyjanek/simplybs/utils"
 	"github.com/ryanuber/go-glob"
 )
 
@@ -21,22 +21,55 @@ type Package struct {
 	Download struct {
 		Kind   string `json:"kind"`
 		URL    string `json:"url"`
-		Sha256 string `json:"sha256"`
+		Sha256 string `json:"sha256,omitempty"`
+		// git only: Commit is required, Tag and Ref are optional and Tree
+		// is the utils.HashTree of the checkout.
+		Commit string `json:"commit,omitempty"`
+		Tag    string `json:"tag,omitempty"`
+		Ref    string `json:"ref,omitempty"`
+		Tree   string `json:"tree,omitempty"`
+		// Optional detached signature of the downloaded file.
+		Signature *Signature `json:"signature,omitempty"`
 	} `json:"download"`
 	Build struct {
 		Env   []string `json:"env"`
 		Steps []string `json:"steps"`
 	} `json:"build"`
-	Dependencies []string `json:"dependencies"`
+	Upstream     *Upstream `json:"upstream,omitempty"`
+	Dependencies []string  `json:"dependencies"`
+	// Host tools the build may use in addition to defaultHostTools, see
+	// Options.HostTools.
+	HostTools []string `json:"host_tools,omitempty"`
+
+	// cfg is the session the package was loaded by.
+	cfg *config
+}
+
+// Signature is a detached signature of a downloaded source, verified
+// against Key, a file in the keys directory of the packages repository.
+type Signature struct {
+	Kind string `json:"kind"` // "openpgp", "minisign" or "signify"
+	URL  string `json:"url"`
+	Key  string `json:"key"`
+}
+
+// Upstream describes where new releases of a package are announced. It is
+// only used by -outdated and does not affect the build.
+type Upstream struct {
+	Kind  string `json:"kind"`  // "listing", "github" or "git"
+	URL   string `json:"url"`   // directory listing, releases JSON or git repository
+	Regex string `json:"regex"` // first capture group is the version
 }
 
 type BuiltFile struct {
-	Builder  string `json:"builder"`   // e.g. "darwin_arm64"
-	Target   string `json:"target"`    // e.g. "aarch64-apple-ios"
-	ID       string `json:"id"`        // short hash
-	InfoPath string `json:"info_path"` // relative path to .info.txt
-	ArchPath string `json:"arch_path"` // relative path to .tar.gz
-	FileSize int64  `json:"file_size"` // size in bytes
+	Builder  string      `json:"builder"`   // e.g. "darwin_arm64"
+	Target   string      `json:"target"`    // e.g. "aarch64-apple-ios"
+	ID       string      `json:"id"`        // short hash
+	InfoPath string      `json:"info_path"` // relative path to .info.txt
+	ArchPath string      `json:"arch_path"` // relative path to .tar.gz
+	LogPath  string      `json:"log_path"`  // relative path to .log, empty if missing
+	Stats    *BuildStats `json:"stats,omitempty"`
+	FileSize int64       `json:"file_size"` // size in bytes
 }
 
 type PackageWithBuilds struct {
@@ -53,7 +86,13 @@ var bootstrapPackages = []string{
 	"native/bootstrap/strip-nondeterminism",
 }
 
+// FindPackage loads the package called name outside of any Session, with
+// the default options.
 func FindPackage(name string) (*Package, error) {
+	return defaultConfig.find(name)
+}
+
+func (c *config) find(name string) (*Package, error) {
 	pkgPath := filepath.Join(host.GetPackagesDir(), name+".json")
 	info, err := os.ReadFile(pkgPath)
 	if err != nil {
@@ -71,14 +110,20 @@ func FindPackage(name string) (*Package, error) {
 		}
 		pkg.Build.Steps = append(pkg.Build.Steps, "all:$PREFIX/native/bootstrap/bin/strip-nondeterminism-recursive $STAGING_DIR")
 	}
+	for _, pkgName := range c.rootfsDependencies(name) {
+		pkg.Dependencies = append(pkg.Dependencies, "all:"+pkgName)
+	}
+	pkg.cfg = c
 	return &pkg, nil
 }
 
-func PrintPackage(pkgName string, host string) {
+func PrintPackage(pkgName string, host string) error {
 	depsByLevel := collectDependenciesByLevel(pkgName, host)
 
 	userPkg, err := FindPackage(pkgName)
-	crash.Handle(err)
+	if err != nil {
+		return err
+	}
 	fmt.Printf("0: %s (version: %s)\n", pkgName, userPkg.Version)
 
 	for level := 1; level < len(depsByLevel); level++ {
@@ -104,6 +149,7 @@ func PrintPackage(pkgName string, host string) {
 			}
 		}
 	}
+	return nil
 }
 
 func ScanBuiltFiles(packageName string, packageVersion string) []BuiltFile {
@@ -158,6 +204,11 @@ func ScanBuiltFiles(packageName string, packageVersion string) []BuiltFile {
 					fileSize = info.Size()
 				}
 				id := strings.Split(parts[len(parts)-1], ".")[0]
+				logPath := strings.TrimSuffix(archPath, ".tar.gz") + ".log"
+				if _, err := os.Stat(filepath.Join(buildlibDir, logPath)); err != nil {
+					logPath = ""
+				}
+				stats, _ := ReadBuildStats(filepath.Join(buildlibDir, strings.TrimSuffix(archPath, ".tar.gz")+".stats.json"))
 
 				builtFiles = append(builtFiles, BuiltFile{
 					Builder:  builder,
@@ -165,6 +216,8 @@ func ScanBuiltFiles(packageName string, packageVersion string) []BuiltFile {
 					ID:       id,
 					InfoPath: infoPath,
 					ArchPath: archPath,
+					LogPath:  logPath,
+					Stats:    stats,
 					FileSize: fileSize,
 				})
 			}
@@ -174,10 +227,14 @@ func ScanBuiltFiles(packageName string, packageVersion string) []BuiltFile {
 	return builtFiles
 }
 
-func Cleanup() {
+// cleanup implements Session.Cleanup.
+func (c *config) cleanup() error {
 	buildlibDir := host.DataDirRoot()
 
-	packages := GetAllPackages()
+	packages, err := c.findAll()
+	if err != nil {
+		return err
+	}
 
 	keepFiles := make(map[string]bool)
 
@@ -190,14 +247,19 @@ func Cleanup() {
 	for _, pkg := range packages {
 		for _, builder := range builders {
 			for _, target := range targets {
-				currentBuildID := pkg.GeneratePackageInfoShortHash(host.SupportedHosts[target])
-
-				currentFileName := fmt.Sprintf("%s-%s-%s", pkg.Package, pkg.Version, currentBuildID)
+				currentFileName, err := pkg.ShortName(host.SupportedHosts[target])
+				if err != nil {
+					return err
+				}
 				archPath := filepath.Join(builder, "built", target, currentFileName+".tar.gz")
 				infoPath := filepath.Join(builder, "built", target, currentFileName+".info.txt")
+				logPath := filepath.Join(builder, "built", target, currentFileName+".log")
+				statsPath := filepath.Join(builder, "built", target, currentFileName+".stats.json")
 
 				keepFiles[archPath] = true
 				keepFiles[infoPath] = true
+				keepFiles[logPath] = true
+				keepFiles[statsPath] = true
 			}
 		}
 	}
@@ -252,7 +314,61 @@ func Cleanup() {
 		}
 	}
 
+	// No other process runs while cleanup holds the data dir lock, so the
+	// other lock files are unused.
+	locks, _ := filepath.Glob(filepath.Join(utils.LocksDir(), "*.lock"))
+	for _, lock := range locks {
+		if filepath.Base(lock) != "datadir.lock" {
+			os.Remove(lock)
+		}
+	}
+
 	fmt.Println("Cleanup completed!")
+	return nil
+}
+
+func CleanupGitMirrors() error {
+	packages, err := GetAllPackages()
+	if err != nil {
+		return err
+	}
+	sources := []utils.GitSource{}
+	for _, pkg := range packages {
+		if pkg.Download.Kind == "git" {
+			sources = append(sources, pkg.GitSource())
+		}
+	}
+	inUse := utils.GitMirrorsInUse(sources)
+
+	fmt.Printf("Cleanup: Will keep %d git mirrors\n", len(inUse))
+
+	mirrors, err := os.ReadDir(utils.GitMirrorsDir())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, mirror := range mirrors {
+		path := filepath.Join(utils.GitMirrorsDir(), mirror.Name())
+		if !inUse[path] {
+			fmt.Printf("Removing unused git mirror: %s\n", mirror.Name())
+			os.RemoveAll(path)
+		}
+	}
+
+	// Per-version clones from before the shared mirrors were introduced.
+	sourceDir := filepath.Join(host.DataDirRoot(), "source")
+	sourceEntries, err := os.ReadDir(sourceDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, source := range sourceEntries {
+		if source.IsDir() && strings.HasSuffix(source.Name(), ".git") {
+			fmt.Printf("Removing legacy git clone: %s\n", source.Name())
+			os.RemoveAll(filepath.Join(sourceDir, source.Name()))
+		}
+	}
+
+	fmt.Println("Git mirror cleanup completed!")
+	return nil
 }
 
 func collectDependenciesByLevel(pkgName string, host string) [][]string {
@@ -0,0 +1,223 @@
+package pack
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/mrcyjanek/simplybs/utils"
+)
+
+// MirrorEntry is a single file of a source mirror, as listed in its
+// index.json.
+type MirrorEntry struct {
+	File    string `json:"file"`
+	Package string `json:"package"`
+	Version string `json:"version"`
+	Sha256  string `json:"sha256"`
+	URL     string `json:"url"`
+	Commit  string `json:"commit,omitempty"`
+}
+
+// mirrorSha256 returns the sha256 of file from the index.json of the source
+// mirror. The entry must have been mirrored from commit, which makes it usable
+// for git exports that have no sha256 pinned.
+func mirrorSha256(ctx context.Context, file, commit string) (string, error) {
+	content, err := utils.FetchURL(ctx, utils.SourceMirror()+"index.json")
+	if err != nil {
+		return "", err
+	}
+	var entries []MirrorEntry
+	if err := json.Unmarshal(content, &entries); err != nil {
+		return "", fmt.Errorf("invalid mirror index: %v", err)
+	}
+	for _, entry := range entries {
+		if entry.File == file && entry.Commit == commit && entry.Sha256 != "" {
+			return entry.Sha256, nil
+		}
+	}
+	return "", fmt.Errorf("%s is not in the mirror index", file)
+}
+
+var patchDirRegexp = regexp.MustCompile(`\$PATCH_DIR/([^\s'"<>;|&)]+)`)
+
+// PatchFiles returns the files below PATCH_DIR referenced by the package
+// build steps.
+func (p *Package) PatchFiles() []string {
+	seen := map[string]bool{}
+	var patches []string
+	for _, step := range p.Build.Steps {
+		for _, match := range patchDirRegexp.FindAllStringSubmatch(step, -1) {
+			if !seen[match[1]] {
+				seen[match[1]] = true
+				patches = append(patches, match[1])
+			}
+		}
+	}
+	sort.Strings(patches)
+	return patches
+}
+
+func copyFileIfChanged(src, dst string) (bool, error) {
+	srcSum, err := utils.FileSha256(src)
+	if err != nil {
+		return false, err
+	}
+	if dstSum, err := utils.FileSha256(dst); err == nil && dstSum == srcSum {
+		return false, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return false, err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return false, err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	return true, os.Rename(tmp, dst)
+}
+
+// createMirror implements Session.Mirror.
+func (c *config) createMirror(ctx context.Context, dir string) error {
+	packages, err := c.findAll()
+	if err != nil {
+		return err
+	}
+
+	entries := []MirrorEntry{}
+	failed := []string{}
+	copied := 0
+	for _, pkg := range packages {
+		if pkg.Download.Kind == "none" {
+			continue
+		}
+		err := pkg.downloadSource(ctx)
+		if err != nil {
+			log.Printf("[%s] Failed to download source: %v", pkg.Package, err)
+			failed = append(failed, pkg.Package)
+			continue
+		}
+
+		sourcePath := pkg.SourcePath()
+		file := filepath.Base(sourcePath)
+		changed, err := copyFileIfChanged(sourcePath, filepath.Join(dir, file))
+		if err != nil {
+			log.Printf("[%s] Failed to copy %s: %v", pkg.Package, file, err)
+			failed = append(failed, pkg.Package)
+			continue
+		}
+		if changed {
+			log.Printf("[%s] Mirrored %s", pkg.Package, file)
+			copied++
+		}
+
+		sum := pkg.Download.Sha256
+		if sum == "" {
+			sum, err = utils.FileSha256(sourcePath)
+			if err != nil {
+				return err
+			}
+		}
+		entries = append(entries, MirrorEntry{
+			File:    file,
+			Package: pkg.Package,
+			Version: pkg.Version,
+			Sha256:  sum,
+			URL:     utils.RedactURL(pkg.Download.URL),
+			Commit:  pkg.Download.Commit,
+		})
+
+		// The detached signature is the only other file a package downloads.
+		if sig := pkg.Download.Signature; sig != nil {
+			file := filepath.Base(sig.URL)
+			sigPath := filepath.Join(filepath.Dir(sourcePath), file)
+			changed, err := copyFileIfChanged(sigPath, filepath.Join(dir, file))
+			if err != nil {
+				log.Printf("[%s] Failed to copy signature %s: %v", pkg.Package, file, err)
+				failed = append(failed, pkg.Package)
+				continue
+			}
+			if changed {
+				log.Printf("[%s] Mirrored %s", pkg.Package, file)
+				copied++
+			}
+			sum, err := utils.FileSha256(sigPath)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, MirrorEntry{
+				File:    file,
+				Package: pkg.Package,
+				Version: pkg.Version,
+				Sha256:  sum,
+				URL:     utils.RedactURL(sig.URL),
+			})
+		}
+	}
+
+	if c.rootfs != nil {
+		seed, err := c.rootfs.seed()
+		if err != nil {
+			return err
+		}
+		archive, err := seed.download(ctx)
+		if err != nil {
+			return err
+		}
+		file := filepath.Base(archive)
+		changed, err := copyFileIfChanged(archive, filepath.Join(dir, file))
+		if err != nil {
+			return err
+		}
+		if changed {
+			log.Printf("[rootfs] Mirrored %s", file)
+			copied++
+		}
+		entries = append(entries, MirrorEntry{
+			File:    file,
+			Package: "rootfs",
+			Sha256:  seed.Sha256,
+			URL:     utils.RedactURL(seed.URL),
+		})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].File < entries[j].File
+	})
+	index, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(filepath.Join(dir, "index.json"), index, 0644)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Mirror %s: %d files indexed, %d files updated", dir, len(entries), copied)
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to mirror %d packages: %v", len(failed), failed)
+	}
+	return nil
+}
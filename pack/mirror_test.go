@@ -0,0 +1,70 @@
+package pack
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mrcyjanek/simplybs/utils"
+)
+
+// TestGitSourceFromMirror checks that git exports are only taken from the
+// source mirror when the package pins their tree.
+func TestGitSourceFromMirror(t *testing.T) {
+	packagesDir := t.TempDir()
+	mirror := t.TempDir()
+	t.Setenv("SIMPLYBS_PACKAGES_DIR", packagesDir)
+	t.Setenv("SIMPLYBS_DATA_DIR", t.TempDir())
+	t.Setenv("SIMPLYBS_MIRROR", "file://"+mirror)
+
+	export := t.TempDir()
+	writeTestFile(t, filepath.Join(export, "README"), "hello\n", 0644)
+	tree, err := utils.HashTree(export)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := strings.Repeat("1", 40)
+	pinned := writeGitPackage(t, packagesDir, "pinned", commit, tree)
+	unpinned := writeGitPackage(t, packagesDir, "unpinned", commit, "")
+
+	// The mirror serves the same export for both, listed in its index.
+	var entries []MirrorEntry
+	for _, path := range []string{pinned, unpinned} {
+		file := filepath.Base(path)
+		sum, err := utils.CreateDeterministicTar(export, filepath.Join(mirror, file), "export")
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, MirrorEntry{File: file, Sha256: sum, Commit: commit})
+	}
+	index, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(mirror, "index.json"), string(index), 0644)
+
+	ctx := context.Background()
+	p, err := FindPackage("pinned")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.DownloadSource(ctx); err != nil {
+		t.Fatalf("export with a pinned tree not taken from the mirror: %v", err)
+	}
+
+	// Without a pinned tree the commit has to be fetched, which fails for
+	// the nonexistent repository.
+	p, err = FindPackage("unpinned")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.DownloadSource(ctx); err == nil {
+		t.Errorf("export without a pinned tree or sha256 taken from the mirror")
+	}
+	if _, err := os.Stat(unpinned); err == nil {
+		t.Errorf("untrusted export left in the source cache")
+	}
+}
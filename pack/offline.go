@@ -0,0 +1,128 @@
+package pack
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/mrcyjanek/simplybs/host"
+	"github.com/mrcyjanek/simplybs/utils"
+)
+
+// SourceAvailable reports whether the package source, its signature and the
+// patches can be obtained without network access, either from the local
+// caches or from a file:// mirror.
+func (p *Package) SourceAvailable(ctx context.Context) bool {
+	return len(p.missingSources(ctx)) == 0
+}
+
+// missingSources describes the files p needs that are neither cached nor in
+// a file:// mirror.
+func (p *Package) missingSources(ctx context.Context) []string {
+	missing := []string{}
+	for _, patch := range p.PatchFiles() {
+		if _, err := os.Stat(filepath.Join(getPatchDir(), patch)); err != nil {
+			missing = append(missing, fmt.Sprintf("%s %s: patch %s", p.Package, p.Version, patch))
+		}
+	}
+	if !p.sourceAvailable(ctx) {
+		source := utils.RedactURL(p.Download.URL)
+		if p.Download.Kind == "git" {
+			source += "@" + p.Download.Commit
+		}
+		missing = append(missing, fmt.Sprintf("%s %s: %s (%s)", p.Package, p.Version, source, filepath.Base(p.SourcePath())))
+	}
+	if sig := p.Download.Signature; sig != nil {
+		// Downloaded next to the source, see utils.DownloadSignature.
+		file := filepath.Base(sig.URL)
+		if _, err := os.Stat(filepath.Join(filepath.Dir(p.SourcePath()), file)); err != nil && !utils.MirrorHasFile(file) {
+			missing = append(missing, fmt.Sprintf("%s %s: signature %s (%s)", p.Package, p.Version, utils.RedactURL(sig.URL), file))
+		}
+	}
+	return missing
+}
+
+func (p *Package) sourceAvailable(ctx context.Context) bool {
+	if p.Download.Kind == "none" {
+		return true
+	}
+	sourcePath := p.SourcePath()
+	if _, err := os.Stat(sourcePath); err == nil {
+		return true
+	}
+	file := filepath.Base(sourcePath)
+	if p.Download.Sha256 != "" && utils.MirrorHasFile(file) {
+		return true
+	}
+	if p.Download.Kind == "git" {
+		// The export of the commit, usable with a pinned tree, or the commit
+		// itself in the git mirrors.
+		if p.Download.Tree == "" {
+			return utils.GitSourceCached(p.GitSource())
+		}
+		if _, err := mirrorSha256(ctx, file, p.Download.Commit); err == nil && utils.MirrorHasFile(file) {
+			return true
+		}
+		return utils.GitSourceCached(p.GitSource())
+	}
+	return false
+}
+
+// BuildClosure returns pkgs and all their dependencies for h, resolved
+// recursively, in build order.
+func BuildClosure(pkgs []*Package, h *host.Host) ([]*Package, error) {
+	seen := map[string]bool{}
+	closure := []*Package{}
+	for _, pkg := range pkgs {
+		order, err := pkg.resolve(h)
+		if err != nil {
+			return nil, err
+		}
+		for _, dep := range order {
+			if !seen[dep.Package] {
+				seen[dep.Package] = true
+				closure = append(closure, dep)
+			}
+		}
+	}
+	return closure, nil
+}
+
+// missingSources implements Session.MissingSources.
+func (c *config) missingSources(ctx context.Context, pkgs []*Package, hosts []*host.Host) ([]string, error) {
+	missing := map[string]bool{}
+	check := func(pkg *Package) {
+		for _, entry := range pkg.missingSources(ctx) {
+			missing[entry] = true
+		}
+	}
+	if entry := c.rootfsSeedMissing(); entry != "" {
+		missing[entry] = true
+	}
+
+	if len(hosts) == 0 {
+		for _, pkg := range pkgs {
+			check(pkg)
+		}
+	}
+	for _, h := range hosts {
+		closure, err := BuildClosure(pkgs, h)
+		if err != nil {
+			return nil, err
+		}
+		for _, pkg := range closure {
+			if !pkg.IsBuilt(h) {
+				check(pkg)
+			}
+		}
+	}
+
+	list := make([]string, 0, len(missing))
+	for entry := range missing {
+		list = append(list, entry)
+	}
+	sort.Strings(list)
+	return list, nil
+}
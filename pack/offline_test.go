@@ -0,0 +1,43 @@
+package pack
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMissingSignature(t *testing.T) {
+	packagesDir := t.TempDir()
+	mirror := t.TempDir()
+	t.Setenv("SIMPLYBS_PACKAGES_DIR", packagesDir)
+	t.Setenv("SIMPLYBS_DATA_DIR", t.TempDir())
+	t.Setenv("SIMPLYBS_MIRROR", "file://"+mirror+"/")
+	writeTestFile(t, filepath.Join(packagesDir, "signed.json"), `{
+		"package": "signed", "version": "1",
+		"download": {"kind": "tar.gz", "url": "https://example.org/signed-1.tar.gz", "sha256": "`+strings.Repeat("a", 64)+`",
+			"signature": {"kind": "openpgp", "url": "https://example.org/signed-1.tar.gz.asc", "key": "signed.asc"}}
+	}`, 0644)
+	p, err := FindPackage("signed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	writeTestFile(t, p.SourcePath(), "source", 0644)
+
+	missing := p.missingSources(ctx)
+	if len(missing) != 1 || !strings.Contains(missing[0], "signature https://example.org/signed-1.tar.gz.asc") {
+		t.Fatalf("missing %v, want the signature", missing)
+	}
+
+	writeTestFile(t, filepath.Join(mirror, "signed-1.tar.gz.asc"), "sig", 0644)
+	if missing := p.missingSources(ctx); len(missing) != 0 {
+		t.Errorf("signature in the mirror reported missing: %v", missing)
+	}
+	os.Remove(filepath.Join(mirror, "signed-1.tar.gz.asc"))
+	writeTestFile(t, filepath.Join(filepath.Dir(p.SourcePath()), "signed-1.tar.gz.asc"), "sig", 0644)
+	if missing := p.missingSources(ctx); len(missing) != 0 {
+		t.Errorf("signature next to the source reported missing: %v", missing)
+	}
+}
@@ -0,0 +1,93 @@
+package pack
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mrcyjanek/simplybs/host"
+)
+
+// failedBuild is written next to a work tree kept by -keep-failed.
+type failedBuild struct {
+	Package    string    `json:"package"`
+	Host       string    `json:"host"`
+	InfoHash   string    `json:"info_hash"`
+	FailedStep int       `json:"failed_step"` // 1-based index into build.steps
+	Step       string    `json:"step"`
+	FailedAt   time.Time `json:"failed_at"`
+}
+
+func (p *Package) failedBuildPath(h *host.Host) (string, error) {
+	work, err := p.GenerateBuildPath(h, "work")
+	if err != nil {
+		return "", err
+	}
+	return work + ".failed.json", nil
+}
+
+func (p *Package) writeFailedBuild(h *host.Host, index int, step string) error {
+	path, err := p.failedBuildPath(h)
+	if err != nil {
+		return err
+	}
+	hash, err := p.GeneratePackageInfoHash(h)
+	if err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(failedBuild{
+		Package:    p.Package,
+		Host:       h.Triplet,
+		InfoHash:   hash,
+		FailedStep: index,
+		Step:       step,
+		FailedAt:   time.Now().UTC(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, content, 0644)
+}
+
+// resumeFrom returns the 1-based step the build of p should resume from, or
+// 0 when it has to start from scratch.
+func (p *Package) resumeFrom(h *host.Host) (int, error) {
+	c := p.config()
+	if !c.Resume {
+		return 0, nil
+	}
+	path, err := p.failedBuildPath(h)
+	if err != nil {
+		return 0, err
+	}
+	hash, err := p.GeneratePackageInfoHash(h)
+	if err != nil {
+		return 0, err
+	}
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var failed failedBuild
+	if err := json.Unmarshal(content, &failed); err != nil {
+		return 0, fmt.Errorf("invalid failed build record %s: %v", path, err)
+	}
+	if failed.InfoHash != hash {
+		return 0, fmt.Errorf("[%s] package changed since the failed build, build it without -resume", p.Package)
+	}
+	if _, err := os.Stat(strings.TrimSuffix(path, ".failed.json")); err != nil {
+		return 0, fmt.Errorf("[%s] kept work tree is missing: %v", p.Package, err)
+	}
+	if c.ResumeStep != 0 {
+		if c.ResumeStep < 1 || c.ResumeStep > len(p.Build.Steps) {
+			return 0, fmt.Errorf("[%s] step %d out of range 1-%d", p.Package, c.ResumeStep, len(p.Build.Steps))
+		}
+		return c.ResumeStep, nil
+	}
+	return failed.FailedStep, nil
+}
@@ -0,0 +1,295 @@
+package pack
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/mrcyjanek/simplybs/host"
+	"github.com/mrcyjanek/simplybs/utils"
+)
+
+// Rootfs is the root filesystem build steps run in with -rootfs, declared in
+// rootfs.json of the packages repository. The seed provides the shell, libc
+// and whatever is needed to build Packages, which are added to the
+// dependencies of every other package just like the bootstrap packages.
+type Rootfs struct {
+	// Seeds are keyed by builder, e.g. "linux_amd64".
+	Seeds    map[string]RootfsSeed `json:"seeds"`
+	Packages []string              `json:"packages"`
+}
+
+type RootfsSeed struct {
+	// Kind is "tar.gz" or "tar.xz".
+	Kind   string `json:"kind"`
+	URL    string `json:"url"`
+	Sha256 string `json:"sha256"`
+}
+
+// RootfsConfigPath returns the path of rootfs.json.
+func RootfsConfigPath() string {
+	return filepath.Join(host.GetPackagesDir(), "rootfs.json")
+}
+
+// loadRootfs reads rootfs.json, every build step of the session then runs
+// chrooted into the root filesystem declared there, inside the sandbox.
+func (c *config) loadRootfs() error {
+	data, err := os.ReadFile(RootfsConfigPath())
+	if err != nil {
+		return err
+	}
+	var r Rootfs
+	if err := json.Unmarshal(data, &r); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", RootfsConfigPath(), err)
+	}
+	if _, err := r.seed(); err != nil {
+		return err
+	}
+	base := map[string]bool{}
+	var walk func(name string) error
+	walk = func(name string) error {
+		if base[name] {
+			return nil
+		}
+		base[name] = true
+		pkg, err := c.find(name)
+		if err != nil {
+			return fmt.Errorf("rootfs package %s: %v", name, err)
+		}
+		for _, dep := range pkg.Dependencies {
+			if err := walk(dep[strings.Index(dep, ":")+1:]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, name := range r.Packages {
+		if err := walk(name); err != nil {
+			return err
+		}
+	}
+	c.rootfs = &r
+	c.rootfsBase = base
+	return nil
+}
+
+// seed returns the seed for this builder.
+func (r *Rootfs) seed() (RootfsSeed, error) {
+	builder := runtime.GOOS + "_" + runtime.GOARCH
+	seed, ok := r.Seeds[builder]
+	if !ok {
+		return seed, fmt.Errorf("%s has no seed for %s", RootfsConfigPath(), builder)
+	}
+	if seed.Sha256 == "" {
+		return seed, fmt.Errorf("the %s seed in %s is not pinned to a sha256", builder, RootfsConfigPath())
+	}
+	if _, err := hex.DecodeString(seed.Sha256); err != nil || len(seed.Sha256) != sha256.Size*2 {
+		return seed, fmt.Errorf("the %s seed in %s has an invalid sha256: %q", builder, RootfsConfigPath(), seed.Sha256)
+	}
+	return seed, nil
+}
+
+// archivePath is where the seed is downloaded to, its name is also the one
+// looked up in source mirrors.
+func (seed RootfsSeed) archivePath() string {
+	return filepath.Join(host.DataDir(), "rootfs", seed.Sha256+"."+seed.Kind)
+}
+
+// download fetches the seed archive unless it is already cached with the
+// expected sha256.
+func (seed RootfsSeed) download(ctx context.Context) (string, error) {
+	archive := seed.archivePath()
+	if _, err := os.Stat(archive); err == nil {
+		sum, err := utils.FileSha256(archive)
+		if err == nil && sum == seed.Sha256 {
+			return archive, nil
+		}
+		log.Printf("Cached rootfs seed %s does not match its sha256, downloading it again", archive)
+		os.Remove(archive)
+	}
+	os.MkdirAll(filepath.Dir(archive), 0755)
+	if err := utils.DownloadFile(ctx, "rootfs", archive, seed.URL, seed.Sha256, false); err != nil {
+		return "", err
+	}
+	return archive, nil
+}
+
+// rootfsSeedMissing describes the rootfs seed when -rootfs is used and the
+// seed is neither extracted, downloaded nor in a file:// mirror.
+func (c *config) rootfsSeedMissing() string {
+	if c.rootfs == nil {
+		return ""
+	}
+	seed, err := c.rootfs.seed()
+	if err != nil {
+		return ""
+	}
+	archive := seed.archivePath()
+	if _, err := os.Stat(filepath.Join(filepath.Dir(archive), seed.Sha256[:16])); err == nil {
+		return ""
+	}
+	if _, err := os.Stat(archive); err == nil || utils.MirrorHasFile(filepath.Base(archive)) {
+		return ""
+	}
+	return fmt.Sprintf("rootfs seed: %s (%s)", utils.RedactURL(seed.URL), filepath.Base(archive))
+}
+
+// rootfsDependencies returns the rootfs packages to add to the
+// dependencies of name.
+func (c *config) rootfsDependencies(name string) []string {
+	if c.rootfs == nil || c.rootfsBase[name] || strings.Contains(name, "/bootstrap/") {
+		return nil
+	}
+	return c.rootfs.Packages
+}
+
+// rootfsInfo is recorded in the package info, so that builds in the rootfs
+// are never mixed up with builds on the host.
+func (c *config) rootfsInfo() interface{} {
+	if c.rootfs == nil {
+		return nil
+	}
+	seed, _ := c.rootfs.seed()
+	return seed.Sha256
+}
+
+// ensureRootfs returns the root filesystem the build steps of p for h run
+// in. The rootfs packages themselves and the bootstrap packages run in the
+// bare seed, every other package in the seed with the native files of the
+// rootfs packages installed into /usr/local.
+func ensureRootfs(ctx context.Context, p *Package, h *host.Host) (string, error) {
+	c := p.config()
+	seed, err := c.rootfs.seed()
+	if err != nil {
+		return "", err
+	}
+	if c.rootfsBase[p.Package] || strings.Contains(p.Package, "/bootstrap/") {
+		return assembleRootfs(seed.Sha256[:16], func(dir string) error {
+			return seed.extract(ctx, dir)
+		})
+	}
+	var pkgs []*Package
+	ids := []string{seed.Sha256}
+	for _, name := range c.rootfs.Packages {
+		pkg, err := c.find(name)
+		if err != nil {
+			return "", fmt.Errorf("rootfs package %s: %v", name, err)
+		}
+		id, err := pkg.ShortName(h)
+		if err != nil {
+			return "", err
+		}
+		pkgs = append(pkgs, pkg)
+		ids = append(ids, id)
+	}
+	sum := sha256.Sum256([]byte(strings.Join(ids, "\n")))
+	name := seed.Sha256[:16] + "-" + hex.EncodeToString(sum[:])[:16]
+	return assembleRootfs(name, func(dir string) error {
+		if err := seed.extract(ctx, dir); err != nil {
+			return err
+		}
+		for _, pkg := range pkgs {
+			if err := installRootfsPackage(pkg, h, dir); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// assembleRootfs creates DataDir/rootfs/<name> with create unless it exists
+// already and returns its path.
+func assembleRootfs(name string, create func(dir string) error) (string, error) {
+	root := filepath.Join(host.DataDir(), "rootfs", name)
+	if _, err := os.Stat(root); err == nil {
+		return root, nil
+	}
+	defer traceSpan("assemble rootfs", "extract", map[string]string{"rootfs": name})()
+	l, err := lock("rootfs-"+name, true)
+	if err != nil {
+		return "", err
+	}
+	defer l.Release()
+	if _, err := os.Stat(root); err == nil {
+		return root, nil
+	}
+	tmp := root + ".tmp"
+	os.RemoveAll(tmp)
+	if err := create(tmp); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, root); err != nil {
+		return "", err
+	}
+	log.Printf("Assembled rootfs %s", root)
+	return root, nil
+}
+
+// extract downloads the seed archive if needed and extracts it into dir.
+func (seed RootfsSeed) extract(ctx context.Context, dir string) error {
+	archive, err := seed.download(ctx)
+	if err != nil {
+		return err
+	}
+	switch seed.Kind {
+	case "tar.gz":
+		return utils.ExtractTarGz(archive, dir)
+	case "tar.xz":
+		return utils.ExtractTarXz(archive, dir)
+	default:
+		return fmt.Errorf("unsupported rootfs seed kind: %s", seed.Kind)
+	}
+}
+
+// installRootfsPackage installs the native files of the built archive of p
+// for h into /usr/local of root.
+func installRootfsPackage(p *Package, h *host.Host, root string) error {
+	tmp := filepath.Join(root, ".simplybs-install")
+	defer os.RemoveAll(tmp)
+	built, err := p.GenerateBuildPath(h, "built")
+	if err != nil {
+		return err
+	}
+	if err := utils.ExtractTarGz(built+".tar.gz", tmp); err != nil {
+		return fmt.Errorf("failed to extract rootfs package %s: %v", p.Package, err)
+	}
+	native := filepath.Join(tmp, "native")
+	if _, err := os.Stat(native); os.IsNotExist(err) {
+		log.Printf("Rootfs package %s has no native files to install", p.Package)
+		return nil
+	}
+	if err := mergeTree(native, filepath.Join(root, "usr", "local")); err != nil {
+		return fmt.Errorf("failed to install rootfs package %s: %v", p.Package, err)
+	}
+	return nil
+}
+
+// mergeTree moves the files below src into dst, replacing files that exist
+// in dst already. Both have to be on the same file system.
+func mergeTree(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		}
+		if existing, err := os.Lstat(target); err == nil && existing.IsDir() {
+			return fmt.Errorf("%s is a directory in the rootfs", target)
+		}
+		return os.Rename(path, target)
+	})
+}
@@ -0,0 +1,265 @@
+package pack
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/mrcyjanek/simplybs/host"
+	"github.com/mrcyjanek/simplybs/utils"
+)
+
+// TestMain lets the test binary act as the sandbox helper for -rootfs
+// builds.
+func TestMain(m *testing.M) {
+	utils.SandboxMain()
+	os.Exit(m.Run())
+}
+
+func writeTestFile(t *testing.T, path, content string, mode os.FileMode) {
+	t.Helper()
+	os.MkdirAll(filepath.Dir(path), 0755)
+	if err := os.WriteFile(path, []byte(content), mode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// createTestArchive packs files (path to content) into a tar.gz at path.
+func createTestArchive(t *testing.T, path string, files map[string]string) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		writeTestFile(t, filepath.Join(dir, name), content, 0755)
+	}
+	os.MkdirAll(filepath.Dir(path), 0755)
+	if err := utils.CreateTarGz(dir, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeBootstrapPackages writes empty bootstrap packages, which every other
+// package depends on, into packagesDir.
+func writeBootstrapPackages(t *testing.T, packagesDir string) {
+	t.Helper()
+	for _, name := range bootstrapPackages {
+		writeTestFile(t, filepath.Join(packagesDir, name+".json"), `{"package": "`+name+`", "version": "1", "type": "native", "download": {"kind": "none"}}`, 0644)
+	}
+}
+
+func TestEnsureRootfs(t *testing.T) {
+	packagesDir := t.TempDir()
+	t.Setenv("SIMPLYBS_PACKAGES_DIR", packagesDir)
+	t.Setenv("SIMPLYBS_DATA_DIR", t.TempDir())
+	writeBootstrapPackages(t, packagesDir)
+	writeTestFile(t, filepath.Join(packagesDir, "native", "tool.json"), `{"package": "native/tool", "version": "1", "type": "native", "download": {"kind": "none"}}`, 0644)
+	writeTestFile(t, filepath.Join(packagesDir, "zlib.json"), `{"package": "zlib", "version": "1", "download": {"kind": "none"}}`, 0644)
+
+	seedPath := filepath.Join(t.TempDir(), "seed.tar.gz")
+	createTestArchive(t, seedPath, map[string]string{
+		"etc/seed-release": "seed\n",
+		"bin/sh":           "#!/bin/sh\n",
+	})
+	content, err := os.ReadFile(seedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(content)
+	seed := RootfsSeed{Kind: "tar.gz", URL: "file://" + seedPath, Sha256: hex.EncodeToString(sum[:])}
+	rootfsJSON, err := json.Marshal(Rootfs{
+		Seeds:    map[string]RootfsSeed{runtime.GOOS + "_" + runtime.GOARCH: seed},
+		Packages: []string{"native/tool"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, RootfsConfigPath(), string(rootfsJSON), 0644)
+	c := &config{}
+	if err := c.loadRootfs(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	h := &host.Host{Triplet: "x86_64-linux-gnu"}
+	tool, err := c.find("native/tool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	built, err := tool.GenerateBuildPath(h, "built")
+	if err != nil {
+		t.Fatal(err)
+	}
+	createTestArchive(t, built+".tar.gz", map[string]string{
+		"native/bin/tool":                    "#!/bin/sh\necho tool\n",
+		"usr/share/buildlib/native-tool.txt": "info\n",
+	})
+
+	// The rootfs packages are built in the bare seed.
+	base, err := ensureRootfs(ctx, tool, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(base, "etc", "seed-release")); err != nil {
+		t.Errorf("seed not extracted: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(base, "usr", "local", "bin", "tool")); err == nil {
+		t.Errorf("rootfs package installed into the rootfs it is built in")
+	}
+
+	zlib, err := c.find("zlib")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(strings.Join(zlib.Dependencies, " "), "all:native/tool") {
+		t.Errorf("rootfs package not added to the dependencies: %v", zlib.Dependencies)
+	}
+	root, err := ensureRootfs(ctx, zlib, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root == base {
+		t.Fatalf("packages outside of the rootfs base use the bare seed %s", root)
+	}
+	info, err := os.Stat(filepath.Join(root, "usr", "local", "bin", "tool"))
+	if err != nil {
+		t.Fatalf("rootfs package not installed: %v", err)
+	}
+	if info.Mode()&0100 == 0 {
+		t.Errorf("installed tool is not executable: %v", info.Mode())
+	}
+	if _, err := os.Stat(filepath.Join(root, "etc", "seed-release")); err != nil {
+		t.Errorf("seed missing below the installed packages: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "usr", "share", "buildlib")); err == nil {
+		t.Errorf("staging info of the rootfs package installed")
+	}
+	if again, err := ensureRootfs(ctx, zlib, h); err != nil || again != root {
+		t.Errorf("second call returned %s, %v, want %s", again, err, root)
+	}
+}
+
+func TestRootfsSeedSha256(t *testing.T) {
+	builder := runtime.GOOS + "_" + runtime.GOARCH
+	for _, sum := range []string{"", "abc", strings.Repeat("z", 64), strings.Repeat("a", 63)} {
+		r := &Rootfs{Seeds: map[string]RootfsSeed{builder: {Kind: "tar.gz", URL: "file:///seed.tar.gz", Sha256: sum}}}
+		if _, err := r.seed(); err == nil {
+			t.Errorf("seed with sha256 %q accepted", sum)
+		}
+	}
+	r := &Rootfs{Seeds: map[string]RootfsSeed{builder: {Kind: "tar.gz", Sha256: strings.Repeat("a", 64)}}}
+	if _, err := r.seed(); err != nil {
+		t.Errorf("valid seed rejected: %v", err)
+	}
+}
+
+func TestRootfsSeedReverified(t *testing.T) {
+	t.Setenv("SIMPLYBS_DATA_DIR", t.TempDir())
+	t.Setenv("SIMPLYBS_MIRROR", "file://"+t.TempDir()+"/")
+	seedPath := filepath.Join(t.TempDir(), "seed.tar.gz")
+	createTestArchive(t, seedPath, map[string]string{"etc/seed-release": "seed\n"})
+	content, err := os.ReadFile(seedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(content)
+	seed := RootfsSeed{Kind: "tar.gz", URL: "file://" + seedPath, Sha256: hex.EncodeToString(sum[:])}
+
+	// A corrupt cached seed is downloaded again instead of being used.
+	writeTestFile(t, seed.archivePath(), "corrupt", 0644)
+	archive, err := seed.download(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(archive); err != nil || string(got) != string(content) {
+		t.Errorf("cached seed not replaced: %v", err)
+	}
+}
+
+// hostSeedFiles returns the host tools in bin/ and the libraries they link
+// against, for a seed to run real build steps in.
+func hostSeedFiles(t *testing.T, tools ...string) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	add := func(name, path string) {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Skipf("cannot copy %s into the seed: %v", path, err)
+		}
+		files[name] = string(content)
+	}
+	for _, tool := range tools {
+		path, err := exec.LookPath(tool)
+		if err != nil {
+			t.Skipf("%s not found: %v", tool, err)
+		}
+		add(filepath.Join("bin", tool), path)
+		out, err := exec.Command("ldd", path).Output()
+		if err != nil {
+			t.Skipf("cannot list the libraries of %s: %v", tool, err)
+		}
+		for _, field := range strings.Fields(string(out)) {
+			if strings.HasPrefix(field, "/") {
+				add(strings.TrimPrefix(field, "/"), field)
+			}
+		}
+	}
+	return files
+}
+
+// TestRootfsPatchDir applies a patch from PATCH_DIR in a -rootfs build.
+func TestRootfsPatchDir(t *testing.T) {
+	if err := utils.SandboxSupported(); err != nil {
+		t.Skip(err)
+	}
+	packagesDir := newTestPackages(t)
+	t.Setenv("SIMPLYBS_MIRROR", "file://"+t.TempDir())
+	writeTestFile(t, filepath.Join(packagesDir, "patched.json"), `{
+		"package": "patched", "version": "1", "download": {"kind": "none"},
+		"build": {"steps": ["all:echo old > file && patch file < $PATCH_DIR/fix.patch && mkdir -p $STAGING_DIR$PREFIX/share && cp file $STAGING_DIR$PREFIX/share/file"]}
+	}`, 0644)
+	work := t.TempDir()
+	t.Chdir(work)
+	writeTestFile(t, filepath.Join(work, "patches", "fix.patch"), "--- a/file\n+++ b/file\n@@ -1 +1 @@\n-old\n+new\n", 0644)
+
+	seedPath := filepath.Join(t.TempDir(), "seed.tar.gz")
+	createTestArchive(t, seedPath, hostSeedFiles(t, "sh", "mkdir", "chmod", "cp", "patch"))
+	content, err := os.ReadFile(seedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(content)
+	rootfsJSON, err := json.Marshal(Rootfs{
+		Seeds: map[string]RootfsSeed{runtime.GOOS + "_" + runtime.GOARCH: {Kind: "tar.gz", URL: "file://" + seedPath, Sha256: hex.EncodeToString(sum[:])}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, RootfsConfigPath(), string(rootfsJSON), 0644)
+
+	s, err := NewSession(Options{Rootfs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	h := &host.Host{Triplet: "x86_64-linux-gnu"}
+	p, err := s.Find("patched")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Build(ctx, p, h); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := s.Extract(ctx, p, h, dir); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := os.ReadFile(filepath.Join(dir, "share", "file")); err != nil || string(content) != "new\n" {
+		t.Errorf("patched file is %q, %v", content, err)
+	}
+}
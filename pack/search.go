@@ -6,7 +6,6 @@ import (
 	"path/filepath"
 	"strings"
 
-	"github.com/mrcyjanek/simplybs/crash"
 	"github.com/mrcyjanek/simplybs/host"
 )
 
@@ -26,7 +25,11 @@ func GetPackagesByList(list string) []*Package {
 	}
 	return packages
 }
-func GetAllPackages() []*Package {
+func GetAllPackages() ([]*Package, error) {
+	return defaultConfig.findAll()
+}
+
+func (c *config) findAll() ([]*Package, error) {
 	packages := []*Package{}
 	packagesDir := host.GetPackagesDir()
 
@@ -35,7 +38,7 @@ func GetAllPackages() []*Package {
 			return err
 		}
 
-		if d.IsDir() || filepath.Ext(path) != ".json" {
+		if d.IsDir() || filepath.Ext(path) != ".json" || path == RootfsConfigPath() {
 			return nil
 		}
 
@@ -47,7 +50,7 @@ func GetAllPackages() []*Package {
 
 		pkgName := relPath[:len(relPath)-len(filepath.Ext(relPath))]
 
-		pkg, err := FindPackage(pkgName)
+		pkg, err := c.find(pkgName)
 		if err != nil {
 			log.Printf("Package %s not found", pkgName)
 			return nil
@@ -55,13 +58,17 @@ func GetAllPackages() []*Package {
 		packages = append(packages, pkg)
 		return nil
 	})
-	crash.Handle(err)
-
-	return packages
+	if err != nil {
+		return nil, err
+	}
+	return packages, nil
 }
 
-func GetAllPackagesWithBuilds() []*PackageWithBuilds {
-	packages := GetAllPackages()
+func GetAllPackagesWithBuilds() ([]*PackageWithBuilds, error) {
+	packages, err := GetAllPackages()
+	if err != nil {
+		return nil, err
+	}
 	packagesWithBuilds := make([]*PackageWithBuilds, len(packages))
 
 	for i, pkg := range packages {
@@ -72,5 +79,5 @@ func GetAllPackagesWithBuilds() []*PackageWithBuilds {
 		}
 	}
 
-	return packagesWithBuilds
+	return packagesWithBuilds, nil
 }
@@ -0,0 +1,288 @@
+package pack
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/mrcyjanek/simplybs/host"
+	"github.com/mrcyjanek/simplybs/utils"
+)
+
+// Options configure a Session, the zero value builds like simplybs without
+// any flags (except for LogTail, which prints no log lines when 0).
+type Options struct {
+	// LogTail is how many lines of the build log are printed when a step
+	// fails.
+	LogTail int
+	// Verbose streams the build step output to the terminal in addition to
+	// the build log.
+	Verbose bool
+	// KeepFailed keeps the work, staging and env directories of a failed
+	// build so that it can be inspected or resumed.
+	KeepFailed bool
+	// Resume makes builds of packages with a kept failed build continue in
+	// the kept work tree, from the failed step or from ResumeStep when it
+	// is not 0. It implies KeepFailed.
+	Resume     bool
+	ResumeStep int
+	// ShellOnFailure opens an interactive shell in the work tree and
+	// environment of a failing build step before the build is aborted.
+	ShellOnFailure bool
+	// KeepGoing keeps building after a package failed, skipping only the
+	// packages that depend on it.
+	KeepGoing bool
+	// Sandbox runs build steps in a Linux namespace sandbox without network
+	// and with a read-only host root, see utils.Sandbox.
+	Sandbox bool
+	// Rootfs runs build steps chrooted into the root filesystem declared in
+	// rootfs.json, see Rootfs. It implies Sandbox.
+	Rootfs bool
+	// HostTools replaces the host part of PATH in build steps with shims
+	// that record every host tool used. In "audit" mode every host tool is
+	// shimmed, in "enforce" mode only the default host tools and the
+	// host_tools of the package.
+	HostTools string
+	// Offline forbids network access, see utils.IsOffline.
+	Offline bool
+	// Events receives every Event of the session. It is called from the
+	// goroutine doing the work and must not block.
+	Events func(Event)
+}
+
+// config is the state of a Session, shared by every package it loads.
+type config struct {
+	Options
+	// rootfs is set with Options.Rootfs, rootfsBase are the rootfs packages
+	// and their dependencies, which are built without the rootfs packages.
+	rootfs     *Rootfs
+	rootfsBase map[string]bool
+	// failures holds the errors of the packages that failed or were
+	// skipped with KeepGoing, by host and package, so that they are not
+	// tried again.
+	failures sync.Map
+	// events serializes the calls of Options.Events.
+	events sync.Mutex
+	// progress is what the session is doing, for the summary printed when
+	// it is interrupted.
+	progress struct {
+		sync.Mutex
+		building []string // innermost last
+		step     string
+		built    []string
+	}
+}
+
+// defaultConfig is used by packages loaded outside of a Session, e.g. with
+// FindPackage. Its options are never changed.
+var defaultConfig = &config{Options: Options{LogTail: 50}}
+
+// config returns the state of the session p was loaded by.
+func (p *Package) config() *config {
+	if p.cfg == nil {
+		return defaultConfig
+	}
+	return p.cfg
+}
+
+// Session is the entry point for using simplybs as a library. Errors are
+// returned instead of exiting and progress is reported through
+// Options.Events, only the log output goes to the standard logger.
+//
+// Sessions are independent of each other, but builds of the same package
+// and env still wait for each other through the locks in the data dir.
+// Cancelling the context of a call stops the running build step together
+// with everything it started and removes the trees of the interrupted
+// builds.
+type Session struct {
+	cfg *config
+}
+
+// NewSession checks opts and returns the session using them.
+func NewSession(opts Options) (*Session, error) {
+	if opts.Sandbox || opts.Rootfs {
+		if err := utils.SandboxSupported(); err != nil {
+			return nil, err
+		}
+		// The rootfs is entered by the sandbox.
+		opts.Sandbox = true
+	}
+	switch opts.HostTools {
+	case "", "audit", "enforce":
+	default:
+		return nil, fmt.Errorf("invalid host tools mode %q, expected audit or enforce", opts.HostTools)
+	}
+	if opts.Resume {
+		opts.KeepFailed = true
+	}
+	cfg := &config{Options: opts}
+	if opts.Rootfs {
+		if err := cfg.loadRootfs(); err != nil {
+			return nil, err
+		}
+	}
+	return &Session{cfg: cfg}, nil
+}
+
+// context returns ctx, offline when the session is.
+func (s *Session) context(ctx context.Context) context.Context {
+	if s.cfg.Offline {
+		return utils.WithOffline(ctx)
+	}
+	return ctx
+}
+
+// own returns p as loaded by the session, packages loaded elsewhere (e.g.
+// with FindPackage) are loaded again by name.
+func (s *Session) own(p *Package) (*Package, error) {
+	if p.cfg == s.cfg {
+		return p, nil
+	}
+	return s.cfg.find(p.Package)
+}
+
+// Find loads the package called name, e.g. "native/make".
+func (s *Session) Find(name string) (*Package, error) {
+	return s.cfg.find(name)
+}
+
+// FindAll loads every package of the packages directory.
+func (s *Session) FindAll() ([]*Package, error) {
+	return s.cfg.findAll()
+}
+
+// Resolve returns the dependencies of p for h, resolved recursively, in
+// build order and followed by p itself.
+func (s *Session) Resolve(p *Package, h *host.Host) ([]*Package, error) {
+	p, err := s.own(p)
+	if err != nil {
+		return nil, err
+	}
+	order, err := p.resolve(h)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(order)-1)
+	for _, dep := range order[:len(order)-1] {
+		names = append(names, dep.Package)
+	}
+	emit(EventResolve, p, h, Event{Dependencies: names})
+	return order, nil
+}
+
+// resolve returns the dependencies of p for h, resolved recursively, in
+// build order and followed by p itself.
+func (p *Package) resolve(h *host.Host) ([]*Package, error) {
+	seen := map[string]bool{}
+	order := []*Package{}
+	var walk func(p *Package) error
+	walk = func(p *Package) error {
+		if seen[p.Package] {
+			return nil
+		}
+		seen[p.Package] = true
+		deps, err := p.HostDependencies(h)
+		if err != nil {
+			return err
+		}
+		for _, dep := range deps {
+			if err := walk(dep); err != nil {
+				return err
+			}
+		}
+		order = append(order, p)
+		return nil
+	}
+	if err := walk(p); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// Download fetches the source of p into the source cache.
+func (s *Session) Download(ctx context.Context, p *Package) error {
+	p, err := s.own(p)
+	if err != nil {
+		return err
+	}
+	return p.DownloadSource(s.context(ctx))
+}
+
+// Build builds p for h, together with its dependencies, unless it is cached.
+func (s *Session) Build(ctx context.Context, p *Package, h *host.Host) error {
+	p, err := s.own(p)
+	if err != nil {
+		return err
+	}
+	return p.EnsureBuilt(s.context(ctx), h)
+}
+
+// Extract extracts the built archive of p for h into dir, e.g.
+// h.GetEnvPath().
+func (s *Session) Extract(ctx context.Context, p *Package, h *host.Host, dir string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	p, err := s.own(p)
+	if err != nil {
+		return err
+	}
+	return p.ExtractEnv(h, dir)
+}
+
+// Shell starts an interactive shell in the work tree of p for h after
+// running the build steps up to runSteps, see Package.StartShell.
+func (s *Session) Shell(ctx context.Context, p *Package, h *host.Host, runSteps int) error {
+	p, err := s.own(p)
+	if err != nil {
+		return err
+	}
+	return p.StartShell(s.context(ctx), h, runSteps)
+}
+
+// Run runs args in the work tree of p for h and returns the exit code, see
+// Package.Run.
+func (s *Session) Run(ctx context.Context, p *Package, h *host.Host, args []string) (int, error) {
+	p, err := s.own(p)
+	if err != nil {
+		return 1, err
+	}
+	return p.Run(s.context(ctx), h, args)
+}
+
+// Mirror copies every source, git export and signature used by any package
+// into dir, using the flat layout that SIMPLYBS_MIRROR expects, and writes
+// index.json. Files that are already present and unchanged are left alone.
+// Patches are not mirrored, they ship with the packages. With
+// Options.Rootfs the seed of this builder is mirrored as well.
+func (s *Session) Mirror(ctx context.Context, dir string) error {
+	return s.cfg.createMirror(s.context(ctx), dir)
+}
+
+// MissingSources lists the sources that would have to be downloaded to
+// build pkgs for every host in hosts. Packages with a valid build cache do
+// not need their source. With no hosts only pkgs themselves are checked.
+// The rootfs seed is included with Options.Rootfs.
+func (s *Session) MissingSources(ctx context.Context, pkgs []*Package, hosts []*host.Host) ([]string, error) {
+	owned := make([]*Package, 0, len(pkgs))
+	for _, p := range pkgs {
+		p, err := s.own(p)
+		if err != nil {
+			return nil, err
+		}
+		owned = append(owned, p)
+	}
+	return s.cfg.missingSources(s.context(ctx), owned, hosts)
+}
+
+// Cleanup removes everything from the data dir except the built archives
+// matching the current packages, as built with the options of the session.
+func (s *Session) Cleanup() error {
+	return s.cfg.cleanup()
+}
+
+// IsOffline reports whether the session, or SIMPLYBS_OFFLINE, forbids
+// network access.
+func (s *Session) IsOffline() bool {
+	return utils.IsOffline(s.context(context.Background()))
+}
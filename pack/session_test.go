@@ -0,0 +1,186 @@
+package pack
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mrcyjanek/simplybs/host"
+)
+
+// newTestPackages creates a packages dir with the bootstrap packages, a
+// strip-nondeterminism that does nothing, "lib" and "app" depending on it.
+func newTestPackages(t *testing.T) string {
+	t.Helper()
+	packagesDir := t.TempDir()
+	t.Setenv("SIMPLYBS_PACKAGES_DIR", packagesDir)
+	t.Setenv("SIMPLYBS_DATA_DIR", t.TempDir())
+	writeBootstrapPackages(t, packagesDir)
+	writeTestFile(t, filepath.Join(packagesDir, "native", "bootstrap", "strip-nondeterminism.json"), `{
+		"package": "native/bootstrap/strip-nondeterminism", "version": "1", "type": "native",
+		"download": {"kind": "none"},
+		"build": {"steps": ["all:mkdir -p $STAGING_DIR$PREFIX/native/bootstrap/bin && printf '#!/bin/sh\\n' > $STAGING_DIR$PREFIX/native/bootstrap/bin/strip-nondeterminism-recursive && chmod +x $STAGING_DIR$PREFIX/native/bootstrap/bin/strip-nondeterminism-recursive"]}
+	}`, 0644)
+	writeTestFile(t, filepath.Join(packagesDir, "lib.json"), `{
+		"package": "lib", "version": "1", "download": {"kind": "none"},
+		"build": {"steps": ["all:mkdir -p $STAGING_DIR$PREFIX/lib && echo lib > $STAGING_DIR$PREFIX/lib/lib.txt"]}
+	}`, 0644)
+	writeTestFile(t, filepath.Join(packagesDir, "app.json"), `{
+		"package": "app", "version": "1", "download": {"kind": "none"},
+		"dependencies": ["all:lib"],
+		"build": {"steps": ["all:cat $PREFIX/lib/lib.txt", "all:mkdir -p $STAGING_DIR$PREFIX/bin && echo app > $STAGING_DIR$PREFIX/bin/app"]}
+	}`, 0644)
+	return packagesDir
+}
+
+// recordEvents returns an Options.Events callback and the events it got.
+func recordEvents() (func(Event), func() []Event) {
+	var mu sync.Mutex
+	var events []Event
+	return func(e Event) {
+			mu.Lock()
+			events = append(events, e)
+			mu.Unlock()
+		}, func() []Event {
+			mu.Lock()
+			defer mu.Unlock()
+			return append([]Event{}, events...)
+		}
+}
+
+func TestNewSessionInvalidHostTools(t *testing.T) {
+	if _, err := NewSession(Options{HostTools: "strict"}); err == nil {
+		t.Errorf("invalid host tools mode accepted")
+	}
+}
+
+func TestSessionResolve(t *testing.T) {
+	newTestPackages(t)
+	handler, events := recordEvents()
+	s, err := NewSession(Options{Events: handler})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Packages loaded outside of the session are loaded again by it.
+	app, err := FindPackage("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	order, err := s.Resolve(app, &host.Host{Triplet: "x86_64-linux-gnu"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, p := range order {
+		if p.cfg != s.cfg {
+			t.Errorf("%s was not loaded by the session", p.Package)
+		}
+		names = append(names, p.Package)
+	}
+	want := len(bootstrapPackages) + 2
+	if len(names) != want || names[want-2] != "lib" || names[want-1] != "app" {
+		t.Fatalf("resolved %v, want the bootstrap packages, lib and app", names)
+	}
+
+	got := events()
+	if len(got) != 1 || got[0].Kind != EventResolve || got[0].Package != "app" {
+		t.Fatalf("got events %+v, want a single resolve event for app", got)
+	}
+	if strings.Join(got[0].Dependencies, " ") != strings.Join(names[:want-1], " ") {
+		t.Errorf("resolve event lists %v, want %v", got[0].Dependencies, names[:want-1])
+	}
+
+	if _, err := s.Find("missing"); err == nil {
+		t.Errorf("missing package found")
+	}
+}
+
+func TestSessionOptionsAreIndependent(t *testing.T) {
+	newTestPackages(t)
+	audit, err := NewSession(Options{HostTools: "audit"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := NewSession(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &host.Host{Triplet: "x86_64-linux-gnu"}
+	info := func(s *Session) string {
+		t.Helper()
+		p, err := s.Find("lib")
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := p.GeneratePackageInfo(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+	if !strings.Contains(info(audit), `"_host_tools": "audit"`) {
+		t.Errorf("host tools mode missing from the package info of the audit session")
+	}
+	if strings.Contains(info(plain), "_host_tools") {
+		t.Errorf("host tools mode of another session leaked into the package info")
+	}
+	lib, err := FindPackage("lib")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := lib.GeneratePackageInfo(h); strings.Contains(info, "_host_tools") {
+		t.Errorf("host tools mode of a session leaked into FindPackage")
+	}
+}
+
+func TestSessionBuild(t *testing.T) {
+	newTestPackages(t)
+	handler, events := recordEvents()
+	s, err := NewSession(Options{LogTail: 10, Events: handler})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	h := &host.Host{Triplet: "x86_64-linux-gnu"}
+	app, err := s.Find("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Build(ctx, app, h); err != nil {
+		t.Fatal(err)
+	}
+	built := map[string]bool{}
+	for _, e := range events() {
+		if e.Kind == EventBuildFinish {
+			built[e.Package] = true
+		}
+	}
+	if !built["lib"] || !built["app"] || len(built) != len(bootstrapPackages)+2 {
+		t.Errorf("built %v, want every package", built)
+	}
+
+	dir := t.TempDir()
+	if err := s.Extract(ctx, app, h, dir); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := os.ReadFile(filepath.Join(dir, "bin", "app")); err != nil || string(content) != "app\n" {
+		t.Errorf("extracted app is %q, %v", content, err)
+	}
+
+	// A second session uses the build cache.
+	handler, events = recordEvents()
+	again, err := NewSession(Options{Events: handler})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := again.Build(ctx, app, h); err != nil {
+		t.Fatal(err)
+	}
+	got := events()
+	if len(got) != 1 || got[0].Kind != EventCacheHit || got[0].Package != "app" {
+		t.Errorf("got events %+v, want a single cache hit", got)
+	}
+}
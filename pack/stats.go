@@ -0,0 +1,93 @@
+package pack
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/mrcyjanek/simplybs/host"
+)
+
+// StepStats is the resource usage of a single build step.
+type StepStats struct {
+	Step        string  `json:"step"`
+	WallSeconds float64 `json:"wall_seconds"`
+	CPUSeconds  float64 `json:"cpu_seconds"`
+	MaxRSS      int64   `json:"max_rss"` // bytes
+}
+
+// BuildStats is the build record stored next to the artifact as
+// .stats.json. It is kept out of .info.txt so it never affects caching.
+type BuildStats struct {
+	Package     string      `json:"package"`
+	Version     string      `json:"version"`
+	Host        string      `json:"host"`
+	Started     time.Time   `json:"started"`
+	WallSeconds float64     `json:"wall_seconds"`
+	CPUSeconds  float64     `json:"cpu_seconds"`
+	MaxRSS      int64       `json:"max_rss"` // bytes, highest of all steps
+	Resumed     bool        `json:"resumed,omitempty"`
+	Steps       []StepStats `json:"steps"`
+	// Host tools used through the -host-tools shims, and those of them
+	// the package does not declare.
+	HostTools           []string `json:"host_tools,omitempty"`
+	UndeclaredHostTools []string `json:"undeclared_host_tools,omitempty"`
+}
+
+func (p *Package) StatsPath(h *host.Host) (string, error) {
+	built, err := p.GenerateBuildPath(h, "built")
+	if err != nil {
+		return "", err
+	}
+	return built + ".stats.json", nil
+}
+
+func newBuildStats(p *Package, h *host.Host) *BuildStats {
+	return &BuildStats{
+		Package: p.Package,
+		Version: p.Version,
+		Host:    h.Triplet,
+		Started: time.Now().UTC(),
+		Steps:   []StepStats{},
+	}
+}
+
+// addStep records the usage of a finished step command.
+func (s *BuildStats) addStep(step string, cmd *exec.Cmd, wall time.Duration) {
+	stats := StepStats{
+		Step:        step,
+		WallSeconds: wall.Seconds(),
+	}
+	if state := cmd.ProcessState; state != nil {
+		stats.CPUSeconds = (state.UserTime() + state.SystemTime()).Seconds()
+		stats.MaxRSS = maxRSS(state)
+	}
+	s.Steps = append(s.Steps, stats)
+	s.CPUSeconds += stats.CPUSeconds
+	if stats.MaxRSS > s.MaxRSS {
+		s.MaxRSS = stats.MaxRSS
+	}
+}
+
+func (s *BuildStats) write(path string) error {
+	s.WallSeconds = time.Since(s.Started).Seconds()
+	content, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, content, 0644)
+}
+
+// ReadBuildStats loads a .stats.json build record.
+func ReadBuildStats(path string) (*BuildStats, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var stats BuildStats
+	if err := json.Unmarshal(content, &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
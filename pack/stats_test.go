@@ -0,0 +1,56 @@
+package pack
+
+import (
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/mrcyjanek/simplybs/host"
+)
+
+func TestBuildStats(t *testing.T) {
+	p := &Package{Package: "zlib", Version: "1.3.1"}
+	stats := newBuildStats(p, &host.Host{Triplet: "x86_64-linux-gnu"})
+
+	cmd := exec.Command("sh", "-c", "i=0; while [ $i -lt 20000 ]; do i=$((i+1)); done")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	stats.addStep("all:busy", cmd, 2*time.Second)
+	// A step that failed to start has no usage.
+	stats.addStep("all:missing", exec.Command("/nonexistent"), time.Second)
+
+	if len(stats.Steps) != 2 {
+		t.Fatalf("got %d steps, want 2", len(stats.Steps))
+	}
+	busy := stats.Steps[0]
+	if busy.Step != "all:busy" || busy.WallSeconds != 2 {
+		t.Errorf("unexpected step %+v", busy)
+	}
+	if runtime.GOOS == "linux" && busy.MaxRSS <= 0 {
+		t.Errorf("MaxRSS not recorded: %+v", busy)
+	}
+	if missing := stats.Steps[1]; missing.CPUSeconds != 0 || missing.MaxRSS != 0 {
+		t.Errorf("step that did not run has usage %+v", missing)
+	}
+	if stats.CPUSeconds != busy.CPUSeconds || stats.MaxRSS != busy.MaxRSS {
+		t.Errorf("totals %v/%d do not match the steps", stats.CPUSeconds, stats.MaxRSS)
+	}
+
+	path := filepath.Join(t.TempDir(), "zlib.stats.json")
+	if err := stats.write(path); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadBuildStats(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.Package != "zlib" || read.Version != "1.3.1" || read.Host != "x86_64-linux-gnu" || len(read.Steps) != 2 {
+		t.Errorf("round trip lost data: %+v", read)
+	}
+	if read.WallSeconds <= 0 || !read.Started.Equal(stats.Started) {
+		t.Errorf("wall time %v, started %v, want %v", read.WallSeconds, read.Started, stats.Started)
+	}
+}
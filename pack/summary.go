@@ -0,0 +1,105 @@
+package pack
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// The outcomes of a package in a Summary.
+const (
+	OutcomeBuilt   = "built"
+	OutcomeCached  = "cached"
+	OutcomeFailed  = "failed"
+	OutcomeSkipped = "skipped"
+)
+
+// Summary collects what happened to every package of a session from its
+// events, for the table printed with -keep-going and the -json result. Only
+// the first outcome of a package counts, later cache hits of a package built
+// in the session do not.
+type Summary struct {
+	mu      sync.Mutex
+	hosts   []string
+	entries []summaryEntry
+	seen    map[string]bool
+}
+
+type summaryEntry struct {
+	outcome string
+	ResultPackage
+}
+
+func NewSummary() *Summary {
+	return &Summary{seen: map[string]bool{}}
+}
+
+// Handle records the outcome of a package, to be used as Options.Events.
+func (s *Summary) Handle(e Event) {
+	entry := summaryEntry{ResultPackage: ResultPackage{Package: e.Package, Host: e.Host}}
+	switch e.Kind {
+	case EventArtifact:
+		entry.outcome = OutcomeBuilt
+		entry.Path = e.Path
+	case EventCacheHit:
+		entry.outcome = OutcomeCached
+		entry.Path = e.Path
+	case EventBuildFailed:
+		entry.outcome = OutcomeFailed
+		entry.Error = e.Error
+	case EventSkipped:
+		entry.outcome = OutcomeSkipped
+		entry.Error = e.Reason
+	default:
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := e.Host + " " + e.Package
+	if s.seen[key] {
+		return
+	}
+	s.seen[key] = true
+	if !slices.Contains(s.hosts, e.Host) {
+		s.hosts = append(s.hosts, e.Host)
+	}
+	s.entries = append(s.entries, entry)
+}
+
+// Packages returns the packages with the given outcome, in the order they
+// finished.
+func (s *Summary) Packages(outcome string) []ResultPackage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	packages := []ResultPackage{}
+	for _, entry := range s.entries {
+		if entry.outcome == outcome {
+			packages = append(packages, entry.ResultPackage)
+		}
+	}
+	return packages
+}
+
+// Print writes the number of packages per outcome and host, followed by the
+// failed and skipped packages.
+func (s *Summary) Print() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Printf("\n%-32s %8s %8s %8s %8s\n", "HOST", "BUILT", "CACHED", "FAILED", "SKIPPED")
+	for _, h := range s.hosts {
+		counts := map[string]int{}
+		for _, entry := range s.entries {
+			if entry.Host == h {
+				counts[entry.outcome]++
+			}
+		}
+		fmt.Printf("%-32s %8d %8d %8d %8d\n", h, counts[OutcomeBuilt], counts[OutcomeCached], counts[OutcomeFailed], counts[OutcomeSkipped])
+	}
+	for _, outcome := range []string{OutcomeFailed, OutcomeSkipped} {
+		for _, entry := range s.entries {
+			if entry.outcome == outcome {
+				fmt.Printf("%-8s %s for %s: %s\n", outcome, entry.Package, entry.Host, entry.Error)
+			}
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package pack
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/mrcyjanek/simplybs/host"
+)
+
+func TestSummaryHandle(t *testing.T) {
+	s := NewSummary()
+	s.Handle(Event{Kind: EventBuildStart, Package: "zlib", Host: "x86_64-linux-gnu"})
+	s.Handle(Event{Kind: EventArtifact, Package: "zlib", Host: "x86_64-linux-gnu", Path: "zlib.tar.gz"})
+	// Later cache hits of a package built in the session do not count.
+	s.Handle(Event{Kind: EventCacheHit, Package: "zlib", Host: "x86_64-linux-gnu", Path: "zlib.tar.gz"})
+	s.Handle(Event{Kind: EventCacheHit, Package: "zlib", Host: "aarch64-linux-gnu", Path: "zlib-arm.tar.gz"})
+	s.Handle(Event{Kind: EventBuildFailed, Package: "curl", Host: "x86_64-linux-gnu", Error: "step failed"})
+	s.Handle(Event{Kind: EventSkipped, Package: "git", Host: "x86_64-linux-gnu", Reason: "dependency curl failed"})
+
+	want := map[string][]ResultPackage{
+		OutcomeBuilt:   {{Package: "zlib", Host: "x86_64-linux-gnu", Path: "zlib.tar.gz"}},
+		OutcomeCached:  {{Package: "zlib", Host: "aarch64-linux-gnu", Path: "zlib-arm.tar.gz"}},
+		OutcomeFailed:  {{Package: "curl", Host: "x86_64-linux-gnu", Error: "step failed"}},
+		OutcomeSkipped: {{Package: "git", Host: "x86_64-linux-gnu", Error: "dependency curl failed"}},
+	}
+	for outcome, packages := range want {
+		got := s.Packages(outcome)
+		if len(got) != len(packages) {
+			t.Errorf("%s: got %v, want %v", outcome, got, packages)
+			continue
+		}
+		for i := range got {
+			if got[i] != packages[i] {
+				t.Errorf("%s: got %v, want %v", outcome, got[i], packages[i])
+			}
+		}
+	}
+	if hosts := s.hosts; len(hosts) != 2 || hosts[0] != "x86_64-linux-gnu" || hosts[1] != "aarch64-linux-gnu" {
+		t.Errorf("hosts %v, want in the order they were seen", hosts)
+	}
+}
+
+// TestKeepGoingSkips builds top, which depends on mid and indep, with mid
+// depending on the failing package.
+func TestKeepGoingSkips(t *testing.T) {
+	packagesDir := newTestPackages(t)
+	writeTestFile(t, filepath.Join(packagesDir, "failing.json"), `{"package": "failing", "version": "1", "download": {"kind": "none"}, "build": {"steps": ["all:exit 3"]}}`, 0644)
+	writeTestFile(t, filepath.Join(packagesDir, "mid.json"), `{"package": "mid", "version": "1", "download": {"kind": "none"}, "dependencies": ["all:failing"]}`, 0644)
+	writeTestFile(t, filepath.Join(packagesDir, "top.json"), `{"package": "top", "version": "1", "download": {"kind": "none"}, "dependencies": ["all:mid", "all:lib"]}`, 0644)
+
+	summary := NewSummary()
+	s, err := NewSession(Options{KeepGoing: true, Events: summary.Handle})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	h := &host.Host{Triplet: "x86_64-linux-gnu"}
+	top, err := s.Find("top")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Build(ctx, top, h)
+	var depErr *DependencyError
+	if !errors.As(err, &depErr) || depErr.Package != "top" || depErr.Failed != "failing" {
+		t.Fatalf("got %v, want top skipped because failing failed", err)
+	}
+
+	if failed := summary.Packages(OutcomeFailed); len(failed) != 1 || failed[0].Package != "failing" {
+		t.Errorf("failed %v, want failing", failed)
+	}
+	skipped := summary.Packages(OutcomeSkipped)
+	if len(skipped) != 2 || skipped[0].Package != "mid" || skipped[1].Package != "top" {
+		t.Fatalf("skipped %v, want mid and top", skipped)
+	}
+	for _, p := range skipped {
+		if p.Error != "dependency failing failed" {
+			t.Errorf("%s skipped with %q, want the failed dependency", p.Package, p.Error)
+		}
+	}
+	// The sibling of the skipped dependency is still built.
+	built := map[string]bool{}
+	for _, p := range summary.Packages(OutcomeBuilt) {
+		built[p.Package] = true
+	}
+	if !built["lib"] || built["top"] || built["mid"] {
+		t.Errorf("built %v, want lib but neither mid nor top", built)
+	}
+
+	// Failures are remembered, the failing package is not tried again.
+	again := NewSummary()
+	s.cfg.Events = again.Handle
+	if err := s.Build(ctx, top, h); !errors.As(err, &depErr) {
+		t.Errorf("second build returned %v", err)
+	}
+	if failed := again.Packages(OutcomeFailed); len(failed) != 0 {
+		t.Errorf("failing package built again: %v", failed)
+	}
+}
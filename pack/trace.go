@@ -0,0 +1,139 @@
+package pack
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tracer writes a Chrome trace-event (Perfetto compatible) JSON array of the
+// build session. Events are written as they happen, so a trace of a failed
+// session is still readable, the closing bracket is optional in this format.
+type tracer struct {
+	mu    sync.Mutex
+	file  *os.File
+	start time.Time
+	first bool
+	// closed is set by StopTrace, spans still referencing the tracer write
+	// nothing after it.
+	closed bool
+	// open are the spans not closed yet, StopTrace closes them.
+	open []*traceEvent
+}
+
+type traceEvent struct {
+	Name  string            `json:"name"`
+	Cat   string            `json:"cat,omitempty"`
+	Phase string            `json:"ph"`
+	TS    int64             `json:"ts"`
+	PID   int               `json:"pid"`
+	TID   int               `json:"tid"`
+	Args  map[string]string `json:"args,omitempty"`
+}
+
+// trace is read by the build goroutines while StopTrace may clear it from
+// the interrupt handler.
+var trace atomic.Pointer[tracer]
+
+// StartTrace starts writing the trace of this session to path.
+func StartTrace(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString("["); err != nil {
+		file.Close()
+		return err
+	}
+	t := &tracer{file: file, start: time.Now(), first: true}
+	t.write(traceEvent{Name: "process_name", Phase: "M", Args: map[string]string{"name": "simplybs"}})
+	trace.Store(t)
+	return nil
+}
+
+// StopTrace closes the spans still open, e.g. when exiting on an error, and
+// finishes the trace file started with StartTrace.
+func StopTrace() {
+	t := trace.Swap(nil)
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := len(t.open) - 1; i >= 0; i-- {
+		t.writeLocked(traceEvent{
+			Name:  t.open[i].Name,
+			Cat:   t.open[i].Cat,
+			Phase: "E",
+			TS:    time.Since(t.start).Microseconds(),
+		})
+	}
+	t.open = nil
+	t.file.WriteString("\n]\n")
+	t.file.Close()
+	t.closed = true
+}
+
+func (t *tracer) write(event traceEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.writeLocked(event)
+}
+
+func (t *tracer) writeLocked(event traceEvent) {
+	if t.closed {
+		return
+	}
+	event.PID = os.Getpid()
+	event.TID = 1
+	content, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	separator := ",\n"
+	if t.first {
+		separator = "\n"
+		t.first = false
+	}
+	fmt.Fprintf(t.file, "%s%s", separator, content)
+}
+
+// traceSpan opens a span and returns the function closing it. Spans opened
+// while another one is open are nested below it. Closing a span twice, or
+// after StopTrace, does nothing.
+func traceSpan(name, category string, args map[string]string) func() {
+	t := trace.Load()
+	if t == nil {
+		return func() {}
+	}
+	span := &traceEvent{Name: name, Cat: category}
+	t.mu.Lock()
+	t.writeLocked(traceEvent{
+		Name:  name,
+		Cat:   category,
+		Phase: "B",
+		TS:    time.Since(t.start).Microseconds(),
+		Args:  args,
+	})
+	t.open = append(t.open, span)
+	t.mu.Unlock()
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		index := slices.Index(t.open, span)
+		if index < 0 {
+			return
+		}
+		t.open = slices.Delete(t.open, index, index+1)
+		t.writeLocked(traceEvent{
+			Name:  name,
+			Cat:   category,
+			Phase: "E",
+			TS:    time.Since(t.start).Microseconds(),
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package pack
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestTraceClosesOpenSpans(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.json")
+	if err := StartTrace(path); err != nil {
+		t.Fatal(err)
+	}
+	endPackage := traceSpan("zlib", "package", nil)
+	endStep := traceSpan("step 1", "step", nil)
+	endStep()
+	endStep()
+	traceSpan("extract env", "extract", nil)
+	// The package and the extraction were left open, as when exiting on an
+	// error.
+	StopTrace()
+	endPackage()
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []traceEvent
+	if err := json.Unmarshal(content, &events); err != nil {
+		t.Fatalf("invalid trace: %v\n%s", err, content)
+	}
+	var phases []string
+	var open []string
+	for _, e := range events {
+		switch e.Phase {
+		case "B":
+			open = append(open, e.Name)
+		case "E":
+			if len(open) == 0 || open[len(open)-1] != e.Name {
+				t.Fatalf("span %s closed out of order, open: %v", e.Name, open)
+			}
+			open = open[:len(open)-1]
+		}
+		phases = append(phases, e.Phase+" "+e.Name)
+	}
+	if len(open) != 0 {
+		t.Errorf("spans left open: %v", open)
+	}
+	if len(phases) != 7 {
+		t.Errorf("got events %v", phases)
+	}
+}
+
+// TestTraceStopWhileSpansRun stops the trace, as the interrupt handler does,
+// while other goroutines keep opening and closing spans.
+func TestTraceStopWhileSpansRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.json")
+	if err := StartTrace(path); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				traceSpan("step", "step", nil)()
+			}
+		}()
+	}
+	StopTrace()
+	wg.Wait()
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []traceEvent
+	if err := json.Unmarshal(content, &events); err != nil {
+		t.Fatalf("invalid trace: %v\n%s", err, content)
+	}
+}
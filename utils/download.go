@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
@@ -9,6 +10,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -19,7 +21,32 @@ type ProgressWriter struct {
 	total      int64
 	written    int64
 	lastUpdate time.Time
+	lastReport time.Time
 	filename   string
+	path       string
+	handler    ProgressHandler
+}
+
+// ProgressHandler receives the progress of a download to path, total is 0
+// when unknown.
+type ProgressHandler func(path string, written, total int64)
+
+type contextKey int
+
+const (
+	offlineKey contextKey = iota
+	progressKey
+)
+
+// WithProgress returns a context in which downloads report their progress
+// to handler about once a second, in addition to the terminal.
+func WithProgress(ctx context.Context, handler ProgressHandler) context.Context {
+	return context.WithValue(ctx, progressKey, handler)
+}
+
+func progressHandler(ctx context.Context) ProgressHandler {
+	handler, _ := ctx.Value(progressKey).(ProgressHandler)
+	return handler
 }
 
 func NewProgressWriter(writer io.Writer, total int64, filename string) *ProgressWriter {
@@ -43,6 +70,10 @@ func (pw *ProgressWriter) Write(p []byte) (int, error) {
 		pw.displayProgress()
 		pw.lastUpdate = time.Now()
 	}
+	if pw.handler != nil && time.Since(pw.lastReport) > time.Second {
+		pw.handler(pw.path, pw.written, max(pw.total, 0))
+		pw.lastReport = time.Now()
+	}
 
 	return n, err
 }
@@ -73,27 +104,101 @@ func formatBytes(bytes int64) string {
 	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp%len("KMGTPE")])
 }
 
-func DownloadFile(packageName, path, url, expectedSha256 string, isMirror bool) error {
-	log.Printf("Downloading %s to %s", url, path)
+const defaultSourceMirror = "http://static.mrcyjanek.net/lfs/simplybs/source/"
 
-	if !isMirror {
-		err := DownloadFile(packageName, path, "http://static.mrcyjanek.net/lfs/simplybs/source/"+filepath.Base(path), expectedSha256, true)
+// SourceMirror returns the base URL sources are looked up in before their
+// original URL, SIMPLYBS_MIRROR can point it at an internal http:// or
+// file:// mirror created with -mirror.
+func SourceMirror() string {
+	mirror := os.Getenv("SIMPLYBS_MIRROR")
+	if mirror == "" {
+		return defaultSourceMirror
+	}
+	if !strings.HasSuffix(mirror, "/") {
+		mirror += "/"
+	}
+	return mirror
+}
+
+// WithOffline returns a context in which the downloaders never use the
+// network, only the local caches and file:// mirrors.
+func WithOffline(ctx context.Context) context.Context {
+	return context.WithValue(ctx, offlineKey, true)
+}
+
+// IsOffline reports whether ctx was made with WithOffline or
+// SIMPLYBS_OFFLINE is set.
+func IsOffline(ctx context.Context) bool {
+	offline, _ := ctx.Value(offlineKey).(bool)
+	return offline || os.Getenv("SIMPLYBS_OFFLINE") != ""
+}
+
+// MirrorHasFile reports whether name is present in a file:// source mirror.
+// Remote mirrors are never checked.
+func MirrorHasFile(name string) bool {
+	mirror := SourceMirror()
+	if !strings.HasPrefix(mirror, "file://") {
+		return false
+	}
+	_, err := os.Stat(strings.TrimPrefix(mirror, "file://") + name)
+	return err == nil
+}
+
+// DownloadFromMirror fetches path from the source mirror only, without
+// falling back to the original URL.
+func DownloadFromMirror(ctx context.Context, packageName, path, expectedSha256 string) error {
+	return DownloadFile(ctx, packageName, path, SourceMirror()+filepath.Base(path), expectedSha256, true)
+}
+
+func FileSha256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func openURL(ctx context.Context, url string) (io.ReadCloser, int64, error) {
+	if strings.HasPrefix(url, "file://") {
+		path := strings.TrimPrefix(url, "file://")
+		file, err := os.Open(path)
 		if err != nil {
-			log.Printf("Failed to download file from mirror: %v, trying original URL", err)
-		} else {
-			log.Printf("Downloaded file from mirror: %s", path)
-			return nil
+			return nil, 0, fmt.Errorf("Failed to open %s: %v", path, err)
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, 0, err
 		}
+		return file, info.Size(), nil
 	}
 
-	resp, err := http.Get(url)
+	if IsOffline(ctx) {
+		return nil, 0, fmt.Errorf("network access is disabled in offline mode: %s", RedactURL(url))
+	}
+
+	client, err := HTTPClient()
+	if err != nil {
+		return nil, 0, err
+	}
+	req, err := newRequest(url)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
 	if err != nil {
-		return fmt.Errorf("Failed to download file from %s: %v", url, err)
+		return nil, 0, fmt.Errorf("Failed to download file from %s: %v", RedactURL(url), redactError(err))
 	}
-	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("Failed to download file: HTTP %d %s", resp.StatusCode, resp.Status)
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("Failed to download file: HTTP %d %s", resp.StatusCode, resp.Status)
 	}
 
 	var totalSize int64
@@ -102,12 +207,133 @@ func DownloadFile(packageName, path, url, expectedSha256 string, isMirror bool)
 			totalSize = size
 		}
 	}
+	return resp.Body, totalSize, nil
+}
+
+// FetchURL returns the body of an http(s):// or file:// URL.
+func FetchURL(ctx context.Context, url string) ([]byte, error) {
+	body, _, err := openURL(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+// maxPages bounds FetchURLPages, in case a server keeps linking pages.
+const maxPages = 100
+
+var nextLinkRegexp = regexp.MustCompile(`<([^>]+)>\s*;[^,]*rel="?next"?`)
+
+// FetchURLPages returns the bodies of url and of every page following it, as
+// linked with rel="next" in the Link header of paginated APIs (e.g. GitHub).
+func FetchURLPages(ctx context.Context, url string) ([][]byte, error) {
+	if strings.HasPrefix(url, "file://") {
+		body, err := FetchURL(ctx, url)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{body}, nil
+	}
+	if IsOffline(ctx) {
+		return nil, fmt.Errorf("network access is disabled in offline mode: %s", RedactURL(url))
+	}
+	client, err := HTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	var pages [][]byte
+	for url != "" {
+		if len(pages) == maxPages {
+			return nil, fmt.Errorf("more than %d pages at %s", maxPages, RedactURL(url))
+		}
+		req, err := newRequest(url)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to fetch %s: %v", RedactURL(url), redactError(err))
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("Failed to fetch %s: HTTP %s", RedactURL(url), resp.Status)
+		}
+		pages = append(pages, body)
+		url = ""
+		if match := nextLinkRegexp.FindStringSubmatch(resp.Header.Get("Link")); match != nil {
+			next, err := resp.Request.URL.Parse(match[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid Link header from %s: %v", RedactURL(req.URL.String()), err)
+			}
+			url = next.String()
+		}
+	}
+	return pages, nil
+}
+
+func DownloadFile(ctx context.Context, packageName, path, url, expectedSha256 string, isMirror bool) error {
+	log.Printf("Downloading %s to %s", RedactURL(url), path)
+
+	if !isMirror {
+		err := DownloadFromMirror(ctx, packageName, path, expectedSha256)
+		if err != nil {
+			log.Printf("Failed to download file from mirror: %v, trying original URL", err)
+		} else {
+			log.Printf("Downloaded file from mirror: %s", path)
+			return nil
+		}
+	}
+
+	// Only a verified download is moved to path, a partial or corrupt file
+	// would be taken for the source.
+	actualHash, err := fetchTemp(ctx, path, url)
+	if err != nil {
+		return err
+	}
+
+	if actualHash != expectedSha256 {
+		os.Remove(path + ".tmp")
+		return fmt.Errorf("SHA256 hash mismatch for %s: expected %s, got %s", path, expectedSha256, actualHash)
+	}
+	if err := CommitFile(path+".tmp", path); err != nil {
+		return err
+	}
+
+	log.Printf("Successfully downloaded and verified %s", path)
+	return nil
+}
+
+// FetchFile downloads url to path without consulting the mirror and returns
+// the sha256 of the file. Callers are responsible for verifying it.
+func FetchFile(ctx context.Context, path, url string) (string, error) {
+	sum, err := fetchTemp(ctx, path, url)
+	if err != nil {
+		return "", err
+	}
+	return sum, CommitFile(path+".tmp", path)
+}
 
-	out, err := os.Create(path)
+// fetchTemp downloads url to path.tmp, synced to disk, and returns its
+// sha256. The caller commits or removes the file.
+func fetchTemp(ctx context.Context, path, url string) (string, error) {
+	body, totalSize, err := openURL(ctx, url)
 	if err != nil {
-		return fmt.Errorf("Failed to create file %s: %v", path, err)
+		return "", err
+	}
+	defer body.Close()
+
+	tmp := path + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return "", fmt.Errorf("Failed to create file %s: %v", tmp, err)
 	}
 	defer out.Close()
+	defer OnInterrupt(func() { os.Remove(tmp) })()
 
 	hasher := sha256.New()
 
@@ -117,21 +343,24 @@ func DownloadFile(packageName, path, url, expectedSha256 string, isMirror bool)
 	}
 
 	progressWriter := NewProgressWriter(out, totalSize, filename)
+	progressWriter.path = path
+	progressWriter.handler = progressHandler(ctx)
 	multiWriter := io.MultiWriter(progressWriter, hasher)
 
-	_, err = io.Copy(multiWriter, resp.Body)
+	_, err = io.Copy(multiWriter, body)
+	if err == nil {
+		err = out.Sync()
+	}
+	if err == nil {
+		err = out.Close()
+	}
 	if err != nil {
-		return fmt.Errorf("Failed to write file %s: %v", path, err)
+		out.Close()
+		os.Remove(tmp)
+		return "", fmt.Errorf("Failed to write file %s: %v", path, err)
 	}
 
 	progressWriter.finish()
 
-	actualHash := hex.EncodeToString(hasher.Sum(nil))
-	if actualHash != expectedSha256 {
-		os.Remove(path)
-		return fmt.Errorf("SHA256 hash mismatch for %s: expected %s, got %s", path, expectedSha256, actualHash)
-	}
-
-	log.Printf("Successfully downloaded and verified %s", path)
-	return nil
+	return hex.EncodeToString(hasher.Sum(nil)), nil
 }
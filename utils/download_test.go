@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDownloadFileVerified(t *testing.T) {
+	t.Setenv("SIMPLYBS_MIRROR", "file://"+t.TempDir()+"/")
+	source := filepath.Join(t.TempDir(), "source.tar.gz")
+	if err := os.WriteFile(source, []byte("source"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("source"))
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "source.tar.gz")
+
+	// A mismatching download leaves neither the file nor its temporary copy.
+	if err := DownloadFile(ctx, "test", path, "file://"+source, "0000", false); err == nil {
+		t.Fatalf("download with the wrong sha256 accepted")
+	}
+	for _, p := range []string{path, path + ".tmp"} {
+		if _, err := os.Stat(p); err == nil {
+			t.Errorf("%s left behind by the failed download", p)
+		}
+	}
+
+	if err := DownloadFile(ctx, "test", path, "file://"+source, hex.EncodeToString(sum[:]), false); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := os.ReadFile(path); err != nil || string(content) != "source" {
+		t.Errorf("downloaded %q, %v", content, err)
+	}
+	if _, err := os.Stat(path + ".tmp"); err == nil {
+		t.Errorf("temporary file left behind")
+	}
+}
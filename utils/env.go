@@ -18,13 +18,23 @@ func ExpandEnvFromMap(s string, envMap map[string]string) string {
 	})
 }
 
+// ValidEnvVar reports whether envVar has the form host:KEY=VALUE.
+func ValidEnvVar(envVar string) bool {
+	colonIndex := strings.Index(envVar, ":")
+	equalIndex := strings.Index(envVar, "=")
+	return colonIndex != -1 && equalIndex != -1
+}
+
+// AppendEnv expands and sets the vars of newEnv matching host. Packages are
+// checked with ValidEnvVar when they are loaded, invalid vars are skipped.
 func AppendEnv(env map[string]string, newEnv []string, host *host.Host) map[string]string {
 	for _, envVar := range newEnv {
 		exp := ExpandEnvFromMap(envVar, env)
 		colonIndex := strings.Index(exp, ":")
 		equalIndex := strings.Index(exp, "=")
 		if colonIndex == -1 || equalIndex == -1 {
-			log.Fatalf("Invalid env var: %s. Vars needs to be in the form of all:KEY=VALUE", exp)
+			log.Printf("Skipping invalid env var: %s. Vars needs to be in the form of all:KEY=VALUE", exp)
+			continue
 		}
 		prefix := exp[0:colonIndex]
 		if !glob.Glob(prefix, host.Triplet) && prefix != "all" {
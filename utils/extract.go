@@ -4,6 +4,8 @@ import (
 	"archive/tar"
 	"compress/bzip2"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"io"
 	"log"
 	"os"
@@ -136,12 +138,27 @@ func extractTar(tr *tar.Reader, destPath, commonPrefix string) error {
 
 			os.Remove(target)
 
+			// No Chtimes here, it follows the link and absolute links
+			// (common in root filesystems) point outside destPath.
 			if err := os.Symlink(header.Linkname, target); err != nil {
 				log.Printf("Warning: Failed to create symbolic link %s -> %s: %v", target, header.Linkname, err)
-			} else {
-				if err := os.Chtimes(target, header.AccessTime, header.ModTime); err != nil {
-					log.Printf("Warning: Failed to set timestamps for symlink %s: %v", target, err)
-				}
+			}
+		case tar.TypeLink:
+			linkName := header.Linkname
+			if commonPrefix != "" {
+				linkName = strings.TrimPrefix(linkName, commonPrefix)
+			}
+			source := filepath.Join(destPath, linkName)
+			if !filepath.HasPrefix(source, filepath.Clean(destPath)+string(os.PathSeparator)) {
+				log.Printf("Skipping hard link outside target directory: %s", header.Name)
+				continue
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			os.Remove(target)
+			if err := os.Link(source, target); err != nil {
+				return err
 			}
 		}
 	}
@@ -149,6 +166,20 @@ func extractTar(tr *tar.Reader, destPath, commonPrefix string) error {
 	return nil
 }
 
+func createPlainTarReader(archivePath string) (*tar.Reader, func(), error) {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tr := tar.NewReader(file)
+	cleanup := func() {
+		file.Close()
+	}
+
+	return tr, cleanup, nil
+}
+
 func createGzipTarReader(archivePath string) (*tar.Reader, func(), error) {
 	file, err := os.Open(archivePath)
 	if err != nil {
@@ -205,6 +236,40 @@ func createXzTarReader(archivePath string) (*tar.Reader, func(), error) {
 	return tr, cleanup, nil
 }
 
+func ExtractTar(archivePath, destPath string) error {
+	if _, err := os.Stat(archivePath); os.IsNotExist(err) {
+		log.Printf("Archive not found: %s", archivePath)
+		return err
+	}
+
+	log.Printf("Extracting tar archive: %s into %s", archivePath, destPath)
+
+	readerFactory := func() (*tar.Reader, func(), error) {
+		return createPlainTarReader(archivePath)
+	}
+
+	commonPrefix, err := detectCommonPrefix(readerFactory)
+	if err != nil {
+		return err
+	}
+
+	tr, cleanup, err := readerFactory()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if err := extractTar(tr, destPath, commonPrefix); err != nil {
+		return err
+	}
+
+	if commonPrefix != "" {
+		log.Printf("Stripped common directory prefix: %s", commonPrefix)
+	}
+
+	return nil
+}
+
 func ExtractTarGz(archivePath, destPath string) error {
 	if _, err := os.Stat(archivePath); os.IsNotExist(err) {
 		log.Printf("Archive not found: %s", archivePath)
@@ -323,10 +388,15 @@ func writeFileToTar(tw *tar.Writer, header *tar.Header, filePath string) error {
 }
 
 func CreateTarGz(sourcePath, archivePath string) error {
-	file, err := os.Create(archivePath)
+	// The archive is written next to archivePath and only renamed into
+	// place once it is complete and synced.
+	tmp := archivePath + ".tmp"
+	defer OnInterrupt(func() { os.Remove(tmp) })()
+	file, err := os.Create(tmp)
 	if err != nil {
 		return err
 	}
+	defer os.Remove(tmp)
 	defer file.Close()
 
 	gzw, err := gzip.NewWriterLevel(file, gzip.BestCompression)
@@ -416,5 +486,141 @@ func CreateTarGz(sourcePath, archivePath string) error {
 		}
 	}
 
-	return nil
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gzw.Close(); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return CommitFile(tmp, archivePath)
+}
+
+// CreateDeterministicTar writes an uncompressed tar of sourcePath with every
+// entry placed under prefix, sorted by name, with fixed timestamps, no owner
+// information and modes normalized to 0755/0644, so that the same tree always
+// produces the same bytes. It returns the sha256 of the archive.
+func CreateDeterministicTar(sourcePath, archivePath, prefix string) (string, error) {
+	file, err := os.Create(archivePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	tw := tar.NewWriter(io.MultiWriter(file, hasher))
+
+	log.Printf("Creating deterministic archive: %s from %s", archivePath, sourcePath)
+
+	var filePaths []string
+	err = filepath.Walk(sourcePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path == sourcePath {
+			return nil
+		}
+
+		filePaths = append(filePaths, path)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	sort.Strings(filePaths)
+
+	fixedTime := time.Unix(1, 0)
+
+	for _, path := range filePaths {
+		info, err := os.Lstat(path)
+		if err != nil {
+			return "", err
+		}
+
+		relPath, err := filepath.Rel(sourcePath, path)
+		if err != nil {
+			return "", err
+		}
+
+		header := &tar.Header{
+			Name:    prefix + "/" + filepath.ToSlash(relPath),
+			ModTime: fixedTime,
+			Format:  tar.FormatPAX,
+		}
+
+		switch {
+		case info.IsDir():
+			header.Typeflag = tar.TypeDir
+			header.Name += "/"
+			header.Mode = 0755
+		case info.Mode()&os.ModeSymlink != 0:
+			linkTarget, err := os.Readlink(path)
+			if err != nil {
+				return "", err
+			}
+			header.Typeflag = tar.TypeSymlink
+			header.Linkname = linkTarget
+			header.Mode = 0777
+		case info.Mode().IsRegular():
+			header.Typeflag = tar.TypeReg
+			header.Size = info.Size()
+			header.Mode = 0644
+			if info.Mode()&0111 != 0 {
+				header.Mode = 0755
+			}
+		default:
+			continue
+		}
+
+		if header.Typeflag == tar.TypeReg {
+			if err := writeFileToTar(tw, header, path); err != nil {
+				return "", err
+			}
+		} else {
+			if err := tw.WriteHeader(header); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+	// Callers commit the archive with CommitFile, which expects it synced.
+	if err := file.Sync(); err != nil {
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// VerifyTarGz reads the whole archive and reports the first error, if any.
+func VerifyTarGz(archivePath string) error {
+	tr, cleanup, err := createGzipTarReader(archivePath)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	for {
+		_, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(io.Discard, tr); err != nil {
+			return err
+		}
+	}
 }
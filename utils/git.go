@@ -1,116 +1,608 @@
 package utils
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/mrcyjanek/simplybs/host"
 )
 
-func optimizeGitRepo(repoPath string) {
-	log.Printf("Optimizing repository at %s", repoPath)
+// GitSource describes a pinned git checkout. Commit is always required, Tag
+// is verified against Commit when set, and Ref is informational only (the
+// branch the commit was taken from). Tree is the HashTree of the checkout,
+// including submodules.
+type GitSource struct {
+	URL    string
+	Commit string
+	Tag    string
+	Ref    string
+	Tree   string
+}
+
+type gitSubmodule struct {
+	Path   string
+	Source GitSource
+}
+
+// GitMirrorsDir is where the bare per-URL mirrors shared by all versions of
+// git sourced packages live.
+func GitMirrorsDir() string {
+	return filepath.Join(host.DataDirRoot(), "git")
+}
+
+func GitMirrorPath(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	name := strings.TrimSuffix(filepath.Base(url), ".git")
+	return filepath.Join(GitMirrorsDir(), name+"-"+hex.EncodeToString(sum[:])[:8]+".git")
+}
+
+func openGitMirror(url string) (*git.Repository, error) {
+	path := GitMirrorPath(url)
+	repo, err := git.PlainOpen(path)
+	if err == nil {
+		return repo, nil
+	}
+	if err != git.ErrRepositoryNotExists {
+		return nil, err
+	}
 
-	repo, err := git.PlainOpen(repoPath)
+	log.Printf("Creating git mirror for %s in %s", RedactURL(url), path)
+	repo, err = git.PlainInit(path, true)
+	if err != nil {
+		return nil, err
+	}
+	_, err = repo.CreateRemote(&config.RemoteConfig{
+		Name: "origin",
+		URLs: []string{url},
+	})
 	if err != nil {
-		log.Printf("Warning: Failed to open repository at %s: %v", repoPath, err)
-		return
+		os.RemoveAll(path)
+		return nil, err
 	}
+	return repo, nil
+}
 
-	remotes, err := repo.Remotes()
-	if err == nil {
-		for _, remote := range remotes {
-			err = repo.DeleteRemote(remote.Config().Name)
-			if err != nil {
-				log.Printf("Warning: Failed to remove remote %s in %s: %v", remote.Config().Name, repoPath, err)
-			}
+func pinnedRefName(commit string) plumbing.ReferenceName {
+	return plumbing.ReferenceName("refs/simplybs/" + commit)
+}
+
+func verifyGitTag(ctx context.Context, repo *git.Repository, src GitSource) error {
+	log.Printf("Verifying that tag %s points at %s", src.Tag, src.Commit)
+	tagged, err := fetchGitTag(ctx, repo, src.Tag)
+	if err != nil {
+		return err
+	}
+	if tagged != src.Commit {
+		return fmt.Errorf("tag %s points at %s, expected %s", src.Tag, tagged, src.Commit)
+	}
+	return nil
+}
+
+// fetchGitTag fetches tag into repo and returns the commit it points at.
+func fetchGitTag(ctx context.Context, repo *git.Repository, tag string) (string, error) {
+	auth, err := originAuth(repo)
+	if err != nil {
+		return "", err
+	}
+	tagRefName := plumbing.NewTagReferenceName(tag)
+	err = repo.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: "origin",
+		Auth:       auth,
+		RefSpecs:   []config.RefSpec{config.RefSpec("+" + tagRefName.String() + ":" + tagRefName.String())},
+		Depth:      1,
+		Tags:       git.NoTags,
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return "", fmt.Errorf("failed to fetch tag %s: %v", tag, err)
+	}
+
+	ref, err := repo.Reference(tagRefName, true)
+	if err != nil {
+		return "", fmt.Errorf("tag %s not found: %v", tag, err)
+	}
+	tagged := ref.Hash()
+	if tagObj, err := repo.TagObject(ref.Hash()); err == nil {
+		commit, err := tagObj.Commit()
+		if err != nil {
+			return "", fmt.Errorf("tag %s does not point at a commit: %v", tag, err)
 		}
+		tagged = commit.Hash
 	}
+	return tagged.String(), nil
+}
 
-	refs, err := repo.References()
-	if err == nil {
-		head, headErr := repo.Head()
-		if headErr == nil {
-			err = refs.ForEach(func(ref *plumbing.Reference) error {
-				if ref.Name().IsBranch() && ref.Hash() != head.Hash() {
-					return repo.Storer.RemoveReference(ref.Name())
-				}
-				return nil
-			})
-			if err != nil {
-				log.Printf("Warning: Failed to remove some branches in %s: %v", repoPath, err)
+func fetchGitCommit(ctx context.Context, repo *git.Repository, url, commit string) error {
+	hash := plumbing.NewHash(commit)
+	log.Printf("Fetching commit %s from %s", commit, RedactURL(url))
+	auth, err := gitAuth(url)
+	if err != nil {
+		return err
+	}
+	err = repo.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: "origin",
+		Auth:       auth,
+		RefSpecs:   []config.RefSpec{config.RefSpec("+" + commit + ":" + pinnedRefName(commit).String())},
+		Depth:      1,
+		Tags:       git.NoTags,
+		Progress:   os.Stdout,
+	})
+	if err == nil || err == git.NoErrAlreadyUpToDate {
+		return nil
+	}
+
+	log.Printf("Shallow fetch of %s failed (%v), falling back to full fetch", commit, err)
+	err = repo.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: "origin",
+		Auth:       auth,
+		RefSpecs:   []config.RefSpec{"+refs/heads/*:refs/heads/*"},
+		Tags:       git.AllTags,
+		Progress:   os.Stdout,
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return err
+	}
+	if _, err := repo.CommitObject(hash); err != nil {
+		return fmt.Errorf("commit %s not found in %s: %v", commit, RedactURL(url), err)
+	}
+	return repo.Storer.SetReference(plumbing.NewHashReference(pinnedRefName(commit), hash))
+}
+
+func resolveSubmoduleURL(parent, url string) string {
+	if !strings.HasPrefix(url, "./") && !strings.HasPrefix(url, "../") {
+		return url
+	}
+	base := strings.TrimSuffix(parent, "/")
+	for {
+		if strings.HasPrefix(url, "./") {
+			url = url[2:]
+		} else if strings.HasPrefix(url, "../") {
+			url = url[3:]
+			if idx := strings.LastIndex(base, "/"); idx >= 0 {
+				base = base[:idx]
 			}
+		} else {
+			break
 		}
 	}
+	return base + "/" + url
+}
+
+// gitSubmodules lists the submodules recorded in commit, pinned to the
+// commits the superproject points at.
+func gitSubmodules(commit *object.Commit, url string) ([]gitSubmodule, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	modulesFile, err := tree.File(".gitmodules")
+	if err == object.ErrFileNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	content, err := modulesFile.Contents()
+	if err != nil {
+		return nil, err
+	}
+	modules := config.NewModules()
+	if err := modules.Unmarshal([]byte(content)); err != nil {
+		return nil, err
+	}
 
-	log.Printf("Repository optimization completed for %s", repoPath)
+	var submodules []gitSubmodule
+	for _, module := range modules.Submodules {
+		entry, err := tree.FindEntry(module.Path)
+		if err != nil || entry.Mode != filemode.Submodule {
+			log.Printf("Warning: submodule %s is not recorded in %s", module.Path, commit.Hash)
+			continue
+		}
+		submodules = append(submodules, gitSubmodule{
+			Path: module.Path,
+			Source: GitSource{
+				URL:    resolveSubmoduleURL(url, module.URL),
+				Commit: entry.Hash.String(),
+			},
+		})
+	}
+	sort.Slice(submodules, func(i, j int) bool {
+		return submodules[i].Path < submodules[j].Path
+	})
+	return submodules, nil
 }
 
-func resolveRef(repo *git.Repository, refStr string) (plumbing.Hash, error) {
-	if len(refStr) == 40 {
-		hash := plumbing.NewHash(refStr)
-		_, err := repo.CommitObject(hash)
-		if err == nil {
-			return hash, nil
+// HashTree returns a sha256 over the sorted paths, modes and contents of every
+// file below path, ignoring git metadata. It is used to verify git checkouts.
+func HashTree(path string) (string, error) {
+	var files []string
+	err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Name() == ".git" {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
 		}
+		if !d.IsDir() {
+			files = append(files, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
 	}
+	sort.Strings(files)
 
-	tagRef, err := repo.Tag(refStr)
-	if err == nil {
-		return tagRef.Hash(), nil
+	hasher := sha256.New()
+	for _, p := range files {
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return "", err
+		}
+		info, err := os.Lstat(p)
+		if err != nil {
+			return "", err
+		}
+		mode := "100644"
+		if info.Mode()&os.ModeSymlink != 0 {
+			mode = "120000"
+		} else if info.Mode()&0111 != 0 {
+			mode = "100755"
+		}
+		fmt.Fprintf(hasher, "%s %s\x00", mode, filepath.ToSlash(rel))
+		if mode == "120000" {
+			target, err := os.Readlink(p)
+			if err != nil {
+				return "", err
+			}
+			io.WriteString(hasher, target)
+		} else {
+			f, err := os.Open(p)
+			if err != nil {
+				return "", err
+			}
+			_, err = io.Copy(hasher, f)
+			f.Close()
+			if err != nil {
+				return "", err
+			}
+		}
+		hasher.Write([]byte{0})
 	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
 
-	branchRef, err := repo.Reference(plumbing.ReferenceName("refs/heads/"+refStr), true)
-	if err == nil {
-		return branchRef.Hash(), nil
+// DownloadGit makes sure the mirror of src.URL (and, recursively, of all its
+// submodules) contains the pinned commit. Unless offline, the tag is verified
+// on every call, even when the commit is already in the mirror.
+func DownloadGit(ctx context.Context, packageName string, src GitSource) error {
+	if len(src.Commit) != 40 {
+		return fmt.Errorf("[%s] git source requires a full 40 character commit, got %q", packageName, src.Commit)
 	}
 
-	remoteRef, err := repo.Reference(plumbing.ReferenceName("refs/remotes/origin/"+refStr), true)
-	if err == nil {
-		return remoteRef.Hash(), nil
+	l, err := AcquireLock("git-"+filepath.Base(GitMirrorPath(src.URL)), true)
+	if err != nil {
+		return err
 	}
+	defer l.Release()
 
-	ref, err := repo.Reference(plumbing.ReferenceName(refStr), true)
-	if err == nil {
-		return ref.Hash(), nil
+	repo, err := openGitMirror(src.URL)
+	if err != nil {
+		return err
 	}
 
-	return plumbing.ZeroHash, err
+	if src.Tag != "" && !IsOffline(ctx) {
+		if err := verifyGitTag(ctx, repo, src); err != nil {
+			return fmt.Errorf("[%s] %v", packageName, err)
+		}
+	}
+	commit, err := repo.CommitObject(plumbing.NewHash(src.Commit))
+	if err != nil {
+		if IsOffline(ctx) {
+			return fmt.Errorf("network access is disabled in offline mode: commit %s of %s is not in the git mirror", src.Commit, RedactURL(src.URL))
+		}
+		if err := fetchGitCommit(ctx, repo, src.URL, src.Commit); err != nil {
+			return err
+		}
+		commit, err = repo.CommitObject(plumbing.NewHash(src.Commit))
+		if err != nil {
+			return err
+		}
+	}
+	submodules, err := gitSubmodules(commit, src.URL)
+	if err != nil {
+		return err
+	}
+	for _, sub := range submodules {
+		log.Printf("[%s] Fetching submodule %s", packageName, sub.Path)
+		if err := DownloadGit(ctx, packageName, sub.Source); err != nil {
+			return fmt.Errorf("submodule %s: %v", sub.Path, err)
+		}
+	}
+	return nil
 }
 
-func DownloadGit(packageName, path, url, expectedSha256 string) error {
-	log.Printf("Downloading %s to %s", url, path)
-
-	repo, err := git.PlainClone(path, false, &git.CloneOptions{
-		URL:      url,
-		Progress: os.Stdout,
-	})
+func exportGitCommit(src GitSource, destPath string) error {
+	repo, err := git.PlainOpen(GitMirrorPath(src.URL))
+	if err != nil {
+		return fmt.Errorf("no git mirror for %s: %v", RedactURL(src.URL), err)
+	}
+	commit, err := repo.CommitObject(plumbing.NewHash(src.Commit))
+	if err != nil {
+		return fmt.Errorf("commit %s missing from mirror of %s: %v", src.Commit, RedactURL(src.URL), err)
+	}
+	tree, err := commit.Tree()
 	if err != nil {
 		return err
 	}
 
-	worktree, err := repo.Worktree()
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+	for {
+		name, entry, err := walker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(destPath, filepath.FromSlash(name))
+		switch entry.Mode {
+		case filemode.Dir, filemode.Submodule:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case filemode.Symlink:
+			blob, err := repo.BlobObject(entry.Hash)
+			if err != nil {
+				return err
+			}
+			reader, err := blob.Reader()
+			if err != nil {
+				return err
+			}
+			link, err := io.ReadAll(reader)
+			reader.Close()
+			if err != nil {
+				return err
+			}
+			os.Remove(target)
+			if err := os.Symlink(string(link), target); err != nil {
+				return err
+			}
+		case filemode.Regular, filemode.Deprecated, filemode.Executable:
+			mode := os.FileMode(0644)
+			if entry.Mode == filemode.Executable {
+				mode = 0755
+			}
+			blob, err := repo.BlobObject(entry.Hash)
+			if err != nil {
+				return err
+			}
+			if err := writeGitBlob(blob, target, mode); err != nil {
+				return err
+			}
+		}
+	}
+
+	submodules, err := gitSubmodules(commit, src.URL)
 	if err != nil {
 		return err
 	}
+	for _, sub := range submodules {
+		err := exportGitCommit(sub.Source, filepath.Join(destPath, filepath.FromSlash(sub.Path)))
+		if err != nil {
+			return fmt.Errorf("submodule %s: %v", sub.Path, err)
+		}
+	}
+	return nil
+}
 
-	log.Printf("Checking out reference %s", expectedSha256)
-	targetHash, err := resolveRef(repo, expectedSha256)
+func writeGitBlob(blob *object.Blob, target string, mode os.FileMode) error {
+	reader, err := blob.Reader()
 	if err != nil {
 		return err
 	}
+	defer reader.Close()
 
-	err = worktree.Checkout(&git.CheckoutOptions{
-		Hash: targetHash,
-	})
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
 	if err != nil {
 		return err
 	}
+	if _, err := io.Copy(out, reader); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
 
-	log.Printf("Cleaning up and optimizing repository...")
+// ExportGit writes the pinned commit of src, including submodules, into
+// destPath without any git metadata, verifies the resulting tree hash and
+// returns it.
+func ExportGit(packageName string, src GitSource, destPath string) (string, error) {
+	log.Printf("Exporting %s at %s into %s", RedactURL(src.URL), src.Commit, destPath)
+	if err := os.MkdirAll(destPath, 0755); err != nil {
+		return "", err
+	}
+	if err := exportGitCommit(src, destPath); err != nil {
+		return "", err
+	}
 
-	optimizeGitRepo(path)
+	treeHash, err := HashTree(destPath)
+	if err != nil {
+		return "", err
+	}
+	if src.Tree == "" {
+		log.Printf("[%s] No tree hash pinned, checkout tree hash is %s", packageName, treeHash)
+	} else if src.Tree != treeHash {
+		return "", fmt.Errorf("tree hash mismatch for %s: expected %s, got %s", RedactURL(src.URL), src.Tree, treeHash)
+	}
+	return treeHash, nil
+}
 
-	log.Printf("Successfully downloaded and optimized %s", path)
+// GitSourceCached reports whether the mirrors already contain the pinned
+// commit of src and of all its submodules.
+func GitSourceCached(src GitSource) bool {
+	repo, err := git.PlainOpen(GitMirrorPath(src.URL))
+	if err != nil {
+		return false
+	}
+	commit, err := repo.CommitObject(plumbing.NewHash(src.Commit))
+	if err != nil {
+		return false
+	}
+	submodules, err := gitSubmodules(commit, src.URL)
+	if err != nil {
+		return false
+	}
+	for _, sub := range submodules {
+		if !GitSourceCached(sub.Source) {
+			return false
+		}
+	}
+	return true
+}
+
+// GitTarballName is the file name of the deterministic export of src, as
+// stored in the source directory and served by source mirrors.
+func GitTarballName(src GitSource) string {
+	return strings.TrimSuffix(filepath.Base(src.URL), ".git") + "-" + src.Commit + ".tar"
+}
+
+// CreateGitTarball exports the pinned commit of src from its mirror into a
+// reproducible tar at tarPath and returns the sha256 of the tarball and the
+// tree hash of the export.
+func CreateGitTarball(packageName string, src GitSource, tarPath string) (string, string, error) {
+	exportPath := tarPath + ".export"
+	os.RemoveAll(exportPath)
+	defer os.RemoveAll(exportPath)
+
+	treeHash, err := ExportGit(packageName, src, exportPath)
+	if err != nil {
+		return "", "", err
+	}
+	prefix := strings.TrimSuffix(GitTarballName(src), ".tar")
+	tmp := tarPath + ".tmp"
+	defer OnInterrupt(func() { os.Remove(tmp) })()
+	sum, err := CreateDeterministicTar(exportPath, tmp, prefix)
+	if err != nil {
+		os.Remove(tmp)
+		return "", "", err
+	}
+	if err := CommitFile(tmp, tarPath); err != nil {
+		return "", "", err
+	}
+	return sum, treeHash, nil
+}
+
+// VerifyGitTarball checks the tree hash of a git export made by
+// CreateGitTarball (e.g. one fetched from a source mirror) against src.Tree.
+// It does nothing when no tree is pinned.
+func VerifyGitTarball(src GitSource, tarPath string) error {
+	if src.Tree == "" {
+		return nil
+	}
+	dir := tarPath + ".verify"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	if err := ExtractTar(tarPath, dir); err != nil {
+		return err
+	}
+	// ExtractTar strips the directory prefix of the export.
+	treeHash, err := HashTree(dir)
+	if err != nil {
+		return err
+	}
+	if treeHash != src.Tree {
+		return fmt.Errorf("tree hash mismatch for %s: expected %s, got %s", tarPath, src.Tree, treeHash)
+	}
 	return nil
 }
+
+// ResolveGitTag returns the commit the tag points at in the repository at
+// url, fetching it into the mirror.
+func ResolveGitTag(ctx context.Context, url, tag string) (string, error) {
+	if IsOffline(ctx) {
+		return "", fmt.Errorf("network access is disabled in offline mode: %s", RedactURL(url))
+	}
+	repo, err := openGitMirror(url)
+	if err != nil {
+		return "", err
+	}
+	return fetchGitTag(ctx, repo, tag)
+}
+
+// GitMirrorsInUse returns the mirror paths needed by sources, following
+// submodules recorded in the mirrors that are already present.
+func GitMirrorsInUse(sources []GitSource) map[string]bool {
+	inUse := map[string]bool{}
+	var visit func(src GitSource)
+	visit = func(src GitSource) {
+		path := GitMirrorPath(src.URL)
+		inUse[path] = true
+		repo, err := git.PlainOpen(path)
+		if err != nil {
+			return
+		}
+		commit, err := repo.CommitObject(plumbing.NewHash(src.Commit))
+		if err != nil {
+			return
+		}
+		submodules, err := gitSubmodules(commit, src.URL)
+		if err != nil {
+			return
+		}
+		for _, sub := range submodules {
+			visit(sub.Source)
+		}
+	}
+	for _, src := range sources {
+		visit(src)
+	}
+	return inUse
+}
+
+// ListGitTags returns the tag names advertised by the repository at url,
+// like git ls-remote --tags.
+func ListGitTags(ctx context.Context, url string) ([]string, error) {
+	if IsOffline(ctx) {
+		return nil, fmt.Errorf("network access is disabled in offline mode: %s", RedactURL(url))
+	}
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+		Name: "origin",
+		URLs: []string{url},
+	})
+	auth, err := gitAuth(url)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := remote.ListContext(ctx, &git.ListOptions{Auth: auth})
+	if err != nil {
+		return nil, err
+	}
+	var tags []string
+	for _, ref := range refs {
+		if ref.Name().IsTag() {
+			tags = append(tags, ref.Name().Short())
+		}
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
@@ -0,0 +1,347 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+const defaultUserAgent = "simplybs"
+
+const defaultHTTPTimeout = 60 * time.Second
+
+var (
+	httpClientOnce sync.Once
+	httpClient     *http.Client
+	httpClientErr  error
+)
+
+// HTTPClient returns the client used for every download. It is configured
+// from the environment:
+//
+//	SIMPLYBS_PROXY        proxy for http(s) and git, defaults to HTTPS_PROXY/HTTP_PROXY/NO_PROXY
+//	SIMPLYBS_CA_BUNDLE    PEM file with CAs trusted in addition to the system ones
+//	SIMPLYBS_HTTP_TIMEOUT connect, response header and body idle timeout (e.g. 30s), default 60s
+//
+// The same client is installed as the go-git http(s) transport.
+func HTTPClient() (*http.Client, error) {
+	httpClientOnce.Do(func() {
+		httpClient, httpClientErr = newHTTPClient()
+		if httpClientErr == nil {
+			gitClient := githttp.NewClient(httpClient)
+			client.InstallProtocol("http", gitClient)
+			client.InstallProtocol("https", gitClient)
+		}
+	})
+	return httpClient, httpClientErr
+}
+
+func newHTTPClient() (*http.Client, error) {
+	timeout := defaultHTTPTimeout
+	if value := os.Getenv("SIMPLYBS_HTTP_TIMEOUT"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SIMPLYBS_HTTP_TIMEOUT %q: %v", value, err)
+		}
+		timeout = parsed
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if value := os.Getenv("SIMPLYBS_PROXY"); value != "" {
+		proxyURL, err := url.Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SIMPLYBS_PROXY: %v", err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	tlsConfig := &tls.Config{}
+	if bundle := os.Getenv("SIMPLYBS_CA_BUNDLE"); bundle != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(bundle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read SIMPLYBS_CA_BUNDLE: %v", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in SIMPLYBS_CA_BUNDLE %s", bundle)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	dialer := &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}
+	return &http.Client{
+		Transport: &idleTimeoutTransport{
+			base: &http.Transport{
+				Proxy:                 proxy,
+				DialContext:           dialer.DialContext,
+				TLSClientConfig:       tlsConfig,
+				TLSHandshakeTimeout:   timeout,
+				ResponseHeaderTimeout: timeout,
+				IdleConnTimeout:       90 * time.Second,
+				ForceAttemptHTTP2:     true,
+			},
+			timeout: timeout,
+		},
+	}, nil
+}
+
+// idleTimeoutTransport cancels a request whose body stalls for longer than
+// timeout. A whole-request timeout would cut off large downloads.
+type idleTimeoutTransport struct {
+	base    http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *idleTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	body := &idleTimeoutBody{body: resp.Body, timeout: t.timeout, cancel: cancel}
+	body.timer = time.AfterFunc(t.timeout, func() {
+		body.expired.Store(true)
+		cancel()
+	})
+	resp.Body = body
+	return resp, nil
+}
+
+// idleTimeoutBody restarts its timer on every Read, the request is cancelled
+// when it fires.
+type idleTimeoutBody struct {
+	body    io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	cancel  context.CancelFunc
+	expired atomic.Bool
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if err != nil && b.expired.Load() {
+		return n, fmt.Errorf("no data received for %s: %w", b.timeout, err)
+	}
+	b.timer.Reset(b.timeout)
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	b.cancel()
+	return b.body.Close()
+}
+
+func userAgent() string {
+	if value := os.Getenv("SIMPLYBS_USER_AGENT"); value != "" {
+		return value
+	}
+	return defaultUserAgent
+}
+
+// Credentials for a single host, either from .netrc or SIMPLYBS_TOKENS.
+type Credentials struct {
+	Login    string
+	Password string
+	Token    string
+}
+
+var (
+	netrcOnce    sync.Once
+	netrcEntries map[string]Credentials
+)
+
+func netrcPath() string {
+	if path := os.Getenv("NETRC"); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".netrc")
+}
+
+// parseNetrc reads machine/default entries of a .netrc file, "default" is
+// stored under the empty host name.
+func parseNetrc(path string) map[string]Credentials {
+	entries := map[string]Credentials{}
+	file, err := os.Open(path)
+	if err != nil {
+		return entries
+	}
+	defer file.Close()
+
+	var fields []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields = append(fields, strings.Fields(line)...)
+	}
+
+	machine := ""
+	inEntry := false
+	for i := 0; i < len(fields); i++ {
+		switch fields[i] {
+		case "machine":
+			if i+1 < len(fields) {
+				i++
+				machine = fields[i]
+				inEntry = true
+			}
+		case "default":
+			machine = ""
+			inEntry = true
+		case "login", "password", "account":
+			if !inEntry || i+1 >= len(fields) {
+				continue
+			}
+			i++
+			creds := entries[machine]
+			switch fields[i-1] {
+			case "login":
+				creds.Login = fields[i]
+			case "password":
+				creds.Password = fields[i]
+			}
+			entries[machine] = creds
+		}
+	}
+	return entries
+}
+
+// CredentialsFor returns the credentials configured for host. Tokens from
+// SIMPLYBS_TOKENS ("host=token,other.host=token") take precedence over
+// .netrc (or $NETRC) entries.
+func CredentialsFor(host string) (Credentials, bool) {
+	for _, entry := range strings.Split(os.Getenv("SIMPLYBS_TOKENS"), ",") {
+		name, token, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if ok && name == host && token != "" {
+			return Credentials{Token: token}, true
+		}
+	}
+
+	netrcOnce.Do(func() {
+		netrcEntries = parseNetrc(netrcPath())
+	})
+	if creds, ok := netrcEntries[host]; ok {
+		return creds, true
+	}
+	creds, ok := netrcEntries[""]
+	return creds, ok
+}
+
+// RedactURL removes any userinfo from rawURL so that it is safe to log.
+func RedactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		// Invalid escapes in the password make the URL unparsable, the
+		// userinfo still has to go.
+		scheme, rest, ok := strings.Cut(rawURL, "://")
+		if !ok {
+			return rawURL
+		}
+		authority, path, hasPath := strings.Cut(rest, "/")
+		at := strings.LastIndex(authority, "@")
+		if at < 0 {
+			return rawURL
+		}
+		redacted := scheme + "://" + authority[at+1:]
+		if hasPath {
+			redacted += "/" + path
+		}
+		return redacted
+	}
+	if u.User == nil {
+		return rawURL
+	}
+	u.User = nil
+	return u.String()
+}
+
+// redactError replaces the URL of a *url.Error with its redacted form.
+func redactError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		urlErr.URL = RedactURL(urlErr.URL)
+	}
+	return err
+}
+
+// newRequest creates a GET request with the user agent and host credentials
+// applied. Credentials embedded in the URL are left to net/http.
+func newRequest(rawURL string) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, redactError(err)
+	}
+	req.Header.Set("User-Agent", userAgent())
+	if req.URL.User == nil {
+		if creds, ok := CredentialsFor(req.URL.Hostname()); ok {
+			if creds.Token != "" {
+				req.Header.Set("Authorization", "Bearer "+creds.Token)
+			} else if creds.Login != "" {
+				req.SetBasicAuth(creds.Login, creds.Password)
+			}
+		}
+	}
+	return req, nil
+}
+
+// gitAuth returns the credentials used to fetch the git repository at
+// rawURL over http(s), or nil when none are configured. It also makes sure
+// go-git uses HTTPClient.
+func gitAuth(rawURL string) (transport.AuthMethod, error) {
+	if _, err := HTTPClient(); err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.User != nil {
+		return nil, nil
+	}
+	creds, ok := CredentialsFor(u.Hostname())
+	if !ok {
+		return nil, nil
+	}
+	if creds.Token != "" {
+		return &githttp.BasicAuth{Username: defaultUserAgent, Password: creds.Token}, nil
+	}
+	if creds.Login == "" {
+		return nil, nil
+	}
+	return &githttp.BasicAuth{Username: creds.Login, Password: creds.Password}, nil
+}
+
+// originAuth returns gitAuth for the origin remote of repo.
+func originAuth(repo *git.Repository) (transport.AuthMethod, error) {
+	remote, err := repo.Remote("origin")
+	if err != nil {
+		return nil, err
+	}
+	return gitAuth(remote.Config().URLs[0])
+}
@@ -0,0 +1,205 @@
+package utils
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// stopGrace is how long running commands get to exit after SIGTERM before
+// they are killed.
+const stopGrace = 5 * time.Second
+
+var interrupts struct {
+	sync.Mutex
+	signal      os.Signal
+	interactive int
+	nextID      int
+	cleanups    map[int]func()
+	processes   map[int]*os.Process
+}
+
+// HandleInterrupts installs the SIGINT/SIGTERM handler. On the first signal
+// it stops every command started with RunCommand, runs the registered
+// cleanups in reverse order, calls summary and exits with 128+signal. A
+// second signal exits right away.
+func HandleInterrupts(summary func(sig os.Signal)) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		var sig os.Signal
+		for sig = range signals {
+			interrupts.Lock()
+			interactive := interrupts.interactive > 0
+			if !interactive {
+				interrupts.signal = sig
+			}
+			interrupts.Unlock()
+			// Interactive children got the signal from the terminal
+			// themselves.
+			if !interactive {
+				break
+			}
+		}
+		go func() {
+			<-signals
+			log.Printf("Interrupted again, exiting without cleanup")
+			os.Exit(SignalExitCode(sig))
+		}()
+
+		log.Printf("Received %v, stopping...", sig)
+		stopProcesses()
+		interrupts.Lock()
+		ids := make([]int, 0, len(interrupts.cleanups))
+		for id := range interrupts.cleanups {
+			ids = append(ids, id)
+		}
+		interrupts.Unlock()
+		sort.Sort(sort.Reverse(sort.IntSlice(ids)))
+		for _, id := range ids {
+			interrupts.Lock()
+			cleanup, ok := interrupts.cleanups[id]
+			interrupts.Unlock()
+			if ok {
+				cleanup()
+			}
+		}
+		summary(sig)
+		os.Exit(SignalExitCode(sig))
+	}()
+}
+
+// SignalExitCode is the exit code of a process ending because of sig.
+func SignalExitCode(sig os.Signal) int {
+	if s, ok := sig.(syscall.Signal); ok {
+		return 128 + int(s)
+	}
+	return 1
+}
+
+// Interrupted reports whether an interrupt is being handled.
+func Interrupted() bool {
+	interrupts.Lock()
+	defer interrupts.Unlock()
+	return interrupts.signal != nil
+}
+
+// BlockIfInterrupted never returns once an interrupt is being handled, so
+// that code noticing a failure caused by the interrupt leaves the cleanup
+// and exit to the handler.
+func BlockIfInterrupted() {
+	if Interrupted() {
+		select {}
+	}
+}
+
+// OnInterrupt registers cleanup to run if the process is interrupted and
+// returns a function that unregisters it.
+func OnInterrupt(cleanup func()) func() {
+	interrupts.Lock()
+	defer interrupts.Unlock()
+	if interrupts.cleanups == nil {
+		interrupts.cleanups = map[int]func(){}
+	}
+	interrupts.nextID++
+	id := interrupts.nextID
+	interrupts.cleanups[id] = cleanup
+	return func() {
+		interrupts.Lock()
+		delete(interrupts.cleanups, id)
+		interrupts.Unlock()
+	}
+}
+
+// Interactive makes the handler ignore signals until done is called, while
+// a command in the foreground of the terminal (a shell) handles them.
+func Interactive() (done func()) {
+	interrupts.Lock()
+	interrupts.interactive++
+	interrupts.Unlock()
+	return func() {
+		interrupts.Lock()
+		interrupts.interactive--
+		interrupts.Unlock()
+	}
+}
+
+// RunCommand runs cmd in its own process group, which is stopped as a
+// whole when the process is interrupted or ctx is done.
+func RunCommand(ctx context.Context, cmd *exec.Cmd) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	setProcessGroup(cmd)
+	interrupts.Lock()
+	if interrupts.signal != nil {
+		interrupts.Unlock()
+		BlockIfInterrupted()
+	}
+	if err := cmd.Start(); err != nil {
+		interrupts.Unlock()
+		return err
+	}
+	if interrupts.processes == nil {
+		interrupts.processes = map[int]*os.Process{}
+	}
+	pid := cmd.Process.Pid
+	interrupts.processes[pid] = cmd.Process
+	interrupts.Unlock()
+
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-exited:
+		case <-ctx.Done():
+			signalProcessGroup(cmd.Process, syscall.SIGTERM)
+			select {
+			case <-exited:
+			case <-time.After(stopGrace):
+				signalProcessGroup(cmd.Process, syscall.SIGKILL)
+			}
+		}
+	}()
+	err := cmd.Wait()
+	close(exited)
+	interrupts.Lock()
+	delete(interrupts.processes, pid)
+	interrupts.Unlock()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// stopProcesses sends SIGTERM to the process groups of running commands and
+// kills them if they are still running after stopGrace.
+func stopProcesses() {
+	interrupts.Lock()
+	for _, process := range interrupts.processes {
+		signalProcessGroup(process, syscall.SIGTERM)
+	}
+	interrupts.Unlock()
+
+	deadline := time.Now().Add(stopGrace)
+	for time.Now().Before(deadline) {
+		interrupts.Lock()
+		running := len(interrupts.processes)
+		interrupts.Unlock()
+		if running == 0 {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	interrupts.Lock()
+	defer interrupts.Unlock()
+	for _, process := range interrupts.processes {
+		log.Printf("Process %d did not stop, killing it", process.Pid)
+		signalProcessGroup(process, syscall.SIGKILL)
+	}
+}
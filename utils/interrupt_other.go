@@ -0,0 +1,15 @@
+//go:build !unix
+
+package utils
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func signalProcessGroup(process *os.Process, sig syscall.Signal) {
+	process.Kill()
+}
@@ -0,0 +1,20 @@
+//go:build unix
+
+package utils
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+func signalProcessGroup(process *os.Process, sig syscall.Signal) {
+	syscall.Kill(-process.Pid, sig)
+}
@@ -0,0 +1,108 @@
+//go:build unix
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// processGone reports whether pid has exited, zombies count as exited.
+func processGone(pid int) bool {
+	if err := syscall.Kill(pid, 0); err != nil {
+		return true
+	}
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	return err == nil && strings.Contains(string(stat), ") Z ")
+}
+
+func TestRunCommandCancel(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	// The background sleep stays in the process group of the shell.
+	cmd := exec.Command("sh", "-c", "sleep 60 & echo $! > "+pidFile+"; wait")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() { done <- RunCommand(ctx, cmd) }()
+
+	var pid int
+	for deadline := time.Now().Add(5 * time.Second); pid == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("command did not start")
+		}
+		content, _ := os.ReadFile(pidFile)
+		pid, _ = strconv.Atoi(strings.TrimSpace(string(content)))
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("RunCommand returned %v, want context.Canceled", err)
+		}
+	case <-time.After(stopGrace / 2):
+		t.Fatal("command was not stopped by SIGTERM")
+	}
+	for deadline := time.Now().Add(2 * time.Second); !processGone(pid); {
+		if time.Now().After(deadline) {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatal("process started by the command survived")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	interrupts.Lock()
+	running := len(interrupts.processes)
+	interrupts.Unlock()
+	if running != 0 {
+		t.Errorf("%d processes still registered", running)
+	}
+}
+
+func TestRunCommandDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cmd := exec.Command("sh", "-c", "exit 0")
+	if err := RunCommand(ctx, cmd); !errors.Is(err, context.Canceled) {
+		t.Errorf("RunCommand with a done context returned %v", err)
+	}
+	if cmd.Process != nil {
+		t.Errorf("command started with a done context")
+	}
+
+	err := RunCommand(context.Background(), exec.Command("sh", "-c", "exit 3"))
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 3 {
+		t.Errorf("RunCommand returned %v, want exit status 3", err)
+	}
+}
+
+func TestSignalExitCode(t *testing.T) {
+	if code := SignalExitCode(syscall.SIGINT); code != 130 {
+		t.Errorf("SIGINT exit code %d, want 130", code)
+	}
+	if code := SignalExitCode(syscall.SIGTERM); code != 143 {
+		t.Errorf("SIGTERM exit code %d, want 143", code)
+	}
+}
+
+func TestOnInterrupt(t *testing.T) {
+	unregister := OnInterrupt(func() {})
+	interrupts.Lock()
+	registered := len(interrupts.cleanups)
+	interrupts.Unlock()
+	unregister()
+	interrupts.Lock()
+	defer interrupts.Unlock()
+	if len(interrupts.cleanups) != registered-1 {
+		t.Errorf("cleanup not unregistered")
+	}
+}
@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/mrcyjanek/simplybs/host"
+)
+
+// Lock is an advisory lock on a file in the locks directory of the data
+// dir, shared by every simplybs process using it. The kernel releases it
+// when the holder dies, so a lock can never outlive its process.
+type Lock struct {
+	file *os.File
+}
+
+// LocksDir holds the lock files.
+func LocksDir() string {
+	return filepath.Join(host.DataDirRoot(), "locks")
+}
+
+// AcquireLock takes the lock called name, waiting (and saying so) while
+// another process holds it. Exclusive locks record the PID of their holder.
+func AcquireLock(name string, exclusive bool) (*Lock, error) {
+	if err := os.MkdirAll(LocksDir(), 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(LocksDir(), strings.NewReplacer("/", "_", string(os.PathSeparator), "_").Replace(name)+".lock")
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	locked, err := tryLockFile(file, exclusive)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if !locked {
+		holder := "another process"
+		if pid := lockHolder(file); pid != 0 {
+			holder = fmt.Sprintf("process %d", pid)
+		}
+		log.Printf("Waiting for %s, %s holds the lock %s", name, holder, path)
+		if err := lockFile(file, exclusive); err != nil {
+			file.Close()
+			return nil, err
+		}
+	} else if pid := lockHolder(file); exclusive && pid != 0 && pid != os.Getpid() {
+		log.Printf("Taking over stale lock %s left by process %d, which is gone", path, pid)
+	}
+
+	if exclusive {
+		file.Truncate(0)
+		file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return &Lock{file: file}, nil
+}
+
+// lockHolder returns the PID recorded in a lock file, 0 if there is none.
+func lockHolder(file *os.File) int {
+	buf := make([]byte, 32)
+	n, _ := file.ReadAt(buf, 0)
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(buf[:n])))
+	return pid
+}
+
+// Release gives up the lock.
+func (l *Lock) Release() {
+	if l == nil {
+		return
+	}
+	l.file.Truncate(0)
+	l.file.Close()
+}
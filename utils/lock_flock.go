@@ -0,0 +1,33 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package utils
+
+import (
+	"os"
+	"syscall"
+)
+
+func flockMode(exclusive bool) int {
+	if exclusive {
+		return syscall.LOCK_EX
+	}
+	return syscall.LOCK_SH
+}
+
+// tryLockFile takes the lock without waiting and reports whether it got it.
+func tryLockFile(file *os.File, exclusive bool) (bool, error) {
+	err := syscall.Flock(int(file.Fd()), flockMode(exclusive)|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func lockFile(file *os.File, exclusive bool) error {
+	for {
+		err := syscall.Flock(int(file.Fd()), flockMode(exclusive))
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
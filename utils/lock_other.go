@@ -0,0 +1,15 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd)
+
+package utils
+
+import "os"
+
+// Locking is only implemented with flock, elsewhere concurrent
+// invocations sharing a data dir are not protected.
+func tryLockFile(file *os.File, exclusive bool) (bool, error) {
+	return true, nil
+}
+
+func lockFile(file *os.File, exclusive bool) error {
+	return nil
+}
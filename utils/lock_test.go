@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// acquireAsync takes the lock in the background and returns a channel
+// receiving it once acquired.
+func acquireAsync(t *testing.T, name string, exclusive bool) <-chan *Lock {
+	t.Helper()
+	acquired := make(chan *Lock, 1)
+	go func() {
+		l, err := AcquireLock(name, exclusive)
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- l
+	}()
+	return acquired
+}
+
+func expectBlocked(t *testing.T, acquired <-chan *Lock) {
+	t.Helper()
+	select {
+	case l := <-acquired:
+		l.Release()
+		t.Fatal("lock acquired while held by another holder")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func expectAcquired(t *testing.T, acquired <-chan *Lock) *Lock {
+	t.Helper()
+	select {
+	case l := <-acquired:
+		return l
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock not acquired after it was released")
+		return nil
+	}
+}
+
+func TestLockContention(t *testing.T) {
+	t.Setenv("SIMPLYBS_DATA_DIR", t.TempDir())
+
+	first, err := AcquireLock("build-x86_64-linux-gnu/zlib", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(LocksDir(), "build-x86_64-linux-gnu_zlib.lock")
+	content, err := os.ReadFile(path)
+	if err != nil || strings.TrimSpace(string(content)) != strconv.Itoa(os.Getpid()) {
+		t.Errorf("lock file records %q, %v", content, err)
+	}
+
+	second := acquireAsync(t, "build-x86_64-linux-gnu/zlib", true)
+	expectBlocked(t, second)
+	first.Release()
+	l := expectAcquired(t, second)
+	shared := acquireAsync(t, "build-x86_64-linux-gnu/zlib", false)
+	expectBlocked(t, shared)
+	l.Release()
+	expectAcquired(t, shared).Release()
+
+	// Another name is independent.
+	other, err := AcquireLock("build-x86_64-linux-gnu/openssl", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Release()
+
+	// Shared locks do not wait for each other but keep exclusive ones out.
+	a := expectAcquired(t, acquireAsync(t, "datadir", false))
+	b := expectAcquired(t, acquireAsync(t, "datadir", false))
+	exclusive := acquireAsync(t, "datadir", true)
+	expectBlocked(t, exclusive)
+	a.Release()
+	expectBlocked(t, exclusive)
+	b.Release()
+	expectAcquired(t, exclusive).Release()
+}
+
+func TestLockStale(t *testing.T) {
+	t.Setenv("SIMPLYBS_DATA_DIR", t.TempDir())
+	os.MkdirAll(LocksDir(), 0755)
+	// A PID left behind by a process that died without releasing the lock.
+	path := filepath.Join(LocksDir(), "env-x86_64-linux-gnu.lock")
+	if err := os.WriteFile(path, []byte("999999999\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l := expectAcquired(t, acquireAsync(t, "env-x86_64-linux-gnu", true))
+	content, _ := os.ReadFile(path)
+	if strings.TrimSpace(string(content)) != strconv.Itoa(os.Getpid()) {
+		t.Errorf("stale lock file records %q", content)
+	}
+	l.Release()
+	if content, _ := os.ReadFile(path); len(content) != 0 {
+		t.Errorf("released lock file records %q", content)
+	}
+}
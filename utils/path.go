@@ -1,9 +1,6 @@
 package utils
 
-import (
-	"log"
-	"runtime"
-)
+import "runtime"
 
 func GetHostPath() string {
 	switch runtime.GOOS {
@@ -12,7 +9,8 @@ func GetHostPath() string {
 	case "linux":
 		return "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
 	default:
-		log.Fatalln("Unsupported OS: ", runtime.GOOS)
-		return ""
+		// Builds are only supported on darwin and linux, this keeps the
+		// package info computable elsewhere.
+		return "/usr/bin:/bin"
 	}
 }
@@ -0,0 +1,275 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/mrcyjanek/simplybs/host"
+)
+
+const sandboxArg = "__simplybs_sandbox"
+
+// Sandbox runs commands in new user, mount and network namespaces: there is
+// no network, the host root is read-only and only Writable (plus a private
+// /tmp) can be written to. With Root set, Root is used as the read-only root
+// filesystem instead of the host one. ReadOnly host paths are bound into it
+// read-only.
+type Sandbox struct {
+	Writable []string
+	ReadOnly []string
+	Root     string
+}
+
+type sandboxConfig struct {
+	Scratch  string   `json:"scratch"`
+	Root     string   `json:"root"`
+	Writable []string `json:"writable"`
+	ReadOnly []string `json:"read_only"`
+	Dir      string   `json:"dir"`
+	Path     string   `json:"path"`
+	Env      []string `json:"env"`
+}
+
+// SandboxSupported reports why sandboxed builds are unavailable, if they
+// are.
+func SandboxSupported() error {
+	if _, err := os.Stat("/proc/self/ns/user"); err != nil {
+		return fmt.Errorf("user namespaces are not available: %v", err)
+	}
+	return nil
+}
+
+func sandboxScratch() string {
+	return filepath.Join(host.DataDir(), "sandbox")
+}
+
+// Wrap makes cmd run inside the sandbox. It has to be called after cmd is
+// fully set up and before it is started.
+func (s *Sandbox) Wrap(cmd *exec.Cmd) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(sandboxScratch(), 0755); err != nil {
+		return err
+	}
+	dir := cmd.Dir
+	if dir == "" {
+		dir, _ = os.Getwd()
+	}
+	env := cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	path := cmd.Path
+	if s.Root != "" && !strings.Contains(cmd.Args[0], "/") {
+		// exec.Command resolved the command on the host.
+		path, err = lookPathIn(s.Root, cmd.Args[0])
+		if err != nil {
+			return err
+		}
+	}
+	config, err := json.Marshal(sandboxConfig{
+		Scratch:  sandboxScratch(),
+		Root:     s.Root,
+		Writable: s.Writable,
+		ReadOnly: s.ReadOnly,
+		Dir:      dir,
+		Path:     path,
+		Env:      env,
+	})
+	if err != nil {
+		return err
+	}
+	// The helper itself runs with the environment of simplybs, the command
+	// gets env once the sandbox is set up.
+	cmd.Env = os.Environ()
+
+	cmd.Args = append([]string{self, sandboxArg, string(config)}, cmd.Args...)
+	cmd.Path = self
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:                 syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWNET,
+		UidMappings:                []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings:                []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+		GidMappingsEnableSetgroups: false,
+		Pdeathsig:                  syscall.SIGKILL,
+	}
+	return nil
+}
+
+// SandboxMain must be called first thing in main. When the process was
+// started by Sandbox.Wrap it sets up the sandbox and executes the wrapped
+// command, it never returns in that case.
+func SandboxMain() {
+	if len(os.Args) < 4 || os.Args[1] != sandboxArg {
+		return
+	}
+	var config sandboxConfig
+	if err := json.Unmarshal([]byte(os.Args[2]), &config); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: invalid config: %v\n", err)
+		os.Exit(125)
+	}
+	if err := enterSandbox(config); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+		os.Exit(125)
+	}
+	err := syscall.Exec(config.Path, os.Args[3:], config.Env)
+	fmt.Fprintf(os.Stderr, "sandbox: failed to execute %s: %v\n", config.Path, err)
+	os.Exit(127)
+}
+
+func enterSandbox(config sandboxConfig) error {
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("failed to make mounts private: %v", err)
+	}
+	// The scratch tmpfs only exists in this mount namespace.
+	if err := syscall.Mount("tmpfs", config.Scratch, "tmpfs", 0, "mode=0755"); err != nil {
+		return fmt.Errorf("failed to mount scratch tmpfs: %v", err)
+	}
+	root := filepath.Join(config.Scratch, "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		return err
+	}
+	source := "/"
+	if config.Root != "" {
+		source = config.Root
+	}
+	if err := syscall.Mount(source, root, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("failed to bind %s as root: %v", source, err)
+	}
+	if config.Root != "" {
+		// The mount points have to exist before the root turns read-only.
+		for _, path := range append(append([]string{"/dev", "/proc", "/tmp"}, config.Writable...), config.ReadOnly...) {
+			os.MkdirAll(filepath.Join(root, path), 0755)
+		}
+	}
+	if err := remountReadOnly(root); err != nil {
+		return err
+	}
+	if config.Root != "" {
+		for _, path := range []string{"/dev", "/proc"} {
+			if err := syscall.Mount(path, filepath.Join(root, path), "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+				return fmt.Errorf("failed to bind %s: %v", path, err)
+			}
+		}
+	}
+
+	for _, tmp := range []string{"/tmp", "/dev/shm"} {
+		if _, err := os.Stat(filepath.Join(root, tmp)); err != nil {
+			continue
+		}
+		if err := syscall.Mount("tmpfs", filepath.Join(root, tmp), "tmpfs", 0, "mode=1777"); err != nil {
+			return fmt.Errorf("failed to mount %s: %v", tmp, err)
+		}
+	}
+	// Writable paths below /tmp need their mount point recreated in the
+	// fresh tmpfs.
+	for _, path := range config.Writable {
+		target := filepath.Join(root, path)
+		os.MkdirAll(target, 0755)
+		if err := syscall.Mount(path, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("failed to make %s writable: %v", path, err)
+		}
+	}
+	for _, path := range config.ReadOnly {
+		target := filepath.Join(root, path)
+		os.MkdirAll(target, 0755)
+		if err := syscall.Mount(path, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("failed to bind %s: %v", path, err)
+		}
+		if err := remountReadOnly(target); err != nil {
+			return err
+		}
+	}
+
+	if err := syscall.Chroot(root); err != nil {
+		return fmt.Errorf("chroot: %v", err)
+	}
+	return os.Chdir(config.Dir)
+}
+
+// lookPathIn finds name in the usual bin directories of root and returns
+// its path inside root.
+func lookPathIn(root, name string) (string, error) {
+	for _, dir := range strings.Split(GetHostPath(), ":") {
+		path := filepath.Join(dir, name)
+		// Lstat, absolute symlinks only resolve inside root.
+		if info, err := os.Lstat(filepath.Join(root, path)); err == nil && !info.IsDir() {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("%s not found in root filesystem %s", name, root)
+}
+
+// remountReadOnly makes root and every mount below it read-only, keeping the
+// flags the kernel does not allow an unprivileged user to drop.
+func remountReadOnly(root string) error {
+	mounts, err := mountPoints(root)
+	if err != nil {
+		return err
+	}
+	for _, mount := range mounts {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(mount, &st); err != nil {
+			continue
+		}
+		keep := uintptr(st.Flags) & (syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC | syscall.MS_NOATIME | syscall.MS_NODIRATIME | syscall.MS_RELATIME)
+		err := syscall.Mount("", mount, "", syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_RDONLY|keep, "")
+		if err != nil && mount == root {
+			return fmt.Errorf("failed to make the root read-only: %v", err)
+		}
+	}
+	return nil
+}
+
+// mountPoints returns root and the mount points below it, parents first.
+func mountPoints(root string) ([]string, error) {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mount := unescapeMountPath(fields[4])
+		if mount == root || strings.HasPrefix(mount, root+"/") {
+			seen[mount] = true
+		}
+	}
+	mounts := make([]string, 0, len(seen))
+	for mount := range seen {
+		mounts = append(mounts, mount)
+	}
+	sort.Strings(mounts)
+	return mounts, scanner.Err()
+}
+
+// unescapeMountPath decodes the octal escapes used in /proc/self/mountinfo.
+func unescapeMountPath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			var c byte
+			if _, err := fmt.Sscanf(path[i+1:i+4], "%03o", &c); err == nil {
+				b.WriteByte(c)
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
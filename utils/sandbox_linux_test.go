@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMain lets the test binary act as the sandbox helper, Wrap re-executes
+// it.
+func TestMain(m *testing.M) {
+	SandboxMain()
+	os.Exit(m.Run())
+}
+
+func runSandboxed(t *testing.T, sb Sandbox, script string) (string, error) {
+	t.Helper()
+	cmd := exec.Command("sh", "-c", script)
+	cmd.Env = []string{"PATH=/usr/bin:/bin", "MARKER=inside"}
+	if err := sb.Wrap(cmd); err != nil {
+		t.Fatal(err)
+	}
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+func TestSandbox(t *testing.T) {
+	if err := SandboxSupported(); err != nil {
+		t.Skip(err)
+	}
+	t.Setenv("SIMPLYBS_DATA_DIR", t.TempDir())
+	writable := t.TempDir()
+	sb := Sandbox{Writable: []string{writable}}
+
+	out, err := runSandboxed(t, sb, "echo $MARKER")
+	if err != nil {
+		t.Skipf("sandbox cannot be entered here: %v\n%s", err, out)
+	}
+	if strings.TrimSpace(out) != "inside" {
+		t.Errorf("environment not passed to the command: %q", out)
+	}
+
+	if out, err := runSandboxed(t, sb, "echo ok > "+filepath.Join(writable, "file")); err != nil {
+		t.Errorf("writable directory is not writable: %v\n%s", err, out)
+	}
+	if _, err := os.Stat(filepath.Join(writable, "file")); err != nil {
+		t.Errorf("write to the writable directory was lost: %v", err)
+	}
+
+	// The command runs in the package directory, which is not writable.
+	if out, err := runSandboxed(t, sb, "touch sandbox-test-file"); err == nil {
+		os.Remove("sandbox-test-file")
+		t.Errorf("host directory outside of Writable is writable\n%s", out)
+	} else if !strings.Contains(out, "Read-only file system") {
+		t.Errorf("unexpected error writing outside of Writable: %v\n%s", err, out)
+	}
+
+	if out, err := runSandboxed(t, sb, "echo private > /tmp/simplybs-sandbox-test && cat /tmp/simplybs-sandbox-test"); err != nil || strings.TrimSpace(out) != "private" {
+		t.Errorf("/tmp is not writable: %v\n%s", err, out)
+	}
+	if _, err := os.Stat("/tmp/simplybs-sandbox-test"); err == nil {
+		os.Remove("/tmp/simplybs-sandbox-test")
+		t.Errorf("/tmp of the sandbox is the host /tmp")
+	}
+
+	// Only the loopback interface exists in the new network namespace.
+	out, err = runSandboxed(t, sb, "tail -n +3 /proc/net/dev | cut -d: -f1")
+	if err != nil {
+		t.Fatalf("failed to list interfaces: %v\n%s", err, out)
+	}
+	if strings.Join(strings.Fields(out), " ") != "lo" {
+		t.Errorf("network interfaces in the sandbox: %q", out)
+	}
+}
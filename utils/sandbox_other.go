@@ -0,0 +1,26 @@
+//go:build !linux
+
+package utils
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+// Sandbox is only implemented on Linux.
+type Sandbox struct {
+	Writable []string
+	ReadOnly []string
+	Root     string
+}
+
+func SandboxSupported() error {
+	return fmt.Errorf("sandboxed builds are not supported on %s", runtime.GOOS)
+}
+
+func (s *Sandbox) Wrap(cmd *exec.Cmd) error {
+	return SandboxSupported()
+}
+
+func SandboxMain() {}
@@ -0,0 +1,199 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"golang.org/x/crypto/blake2b"
+)
+
+// DownloadSignature fetches the detached signature at sigURL next to
+// sourcePath, preferring the source mirror, and verifies it against the
+// trusted key at keyPath. It returns the path of the signature file.
+func DownloadSignature(ctx context.Context, kind, sourcePath, sigURL, keyPath string) (string, error) {
+	sigPath := filepath.Join(filepath.Dir(sourcePath), filepath.Base(sigURL))
+	if _, err := os.Stat(sigPath); os.IsNotExist(err) {
+		_, err := FetchFile(ctx, sigPath, SourceMirror()+filepath.Base(sigPath))
+		if err != nil {
+			_, err = FetchFile(ctx, sigPath, sigURL)
+		}
+		if err != nil {
+			os.Remove(sigPath)
+			return "", fmt.Errorf("missing signature %s: %v", RedactURL(sigURL), err)
+		}
+	}
+	if err := VerifySignature(kind, sourcePath, sigPath, keyPath); err != nil {
+		os.Remove(sigPath)
+		return "", fmt.Errorf("signature verification failed for %s: %v", sourcePath, err)
+	}
+	return sigPath, nil
+}
+
+// VerifySignature checks the detached signature at sigPath for the file at
+// dataPath against the trusted key at keyPath. kind is "openpgp",
+// "minisign" or "signify".
+func VerifySignature(kind, dataPath, sigPath, keyPath string) error {
+	key, err := os.ReadFile(keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to read trusted key %s: %v", keyPath, err)
+	}
+	sig, err := os.ReadFile(sigPath)
+	if err != nil {
+		return fmt.Errorf("failed to read signature %s: %v", sigPath, err)
+	}
+	data, err := os.Open(dataPath)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+
+	switch kind {
+	case "openpgp":
+		return verifyOpenPGP(key, sig, data)
+	case "minisign":
+		return verifyMinisign(key, sig, data)
+	case "signify":
+		return verifySignify(key, sig, data)
+	default:
+		return fmt.Errorf("unsupported signature kind %q", kind)
+	}
+}
+
+func verifyOpenPGP(key, sig []byte, data io.Reader) error {
+	var keyring openpgp.EntityList
+	var err error
+	if bytes.HasPrefix(bytes.TrimSpace(key), []byte("-----BEGIN")) {
+		keyring, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(key))
+	} else {
+		keyring, err = openpgp.ReadKeyRing(bytes.NewReader(key))
+	}
+	if err != nil {
+		return fmt.Errorf("invalid OpenPGP keyring: %v", err)
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(sig), []byte("-----BEGIN")) {
+		_, err = openpgp.CheckArmoredDetachedSignature(keyring, data, bytes.NewReader(sig), nil)
+	} else {
+		_, err = openpgp.CheckDetachedSignature(keyring, data, bytes.NewReader(sig), nil)
+	}
+	if err != nil {
+		return fmt.Errorf("bad OpenPGP signature: %v", err)
+	}
+	return nil
+}
+
+// readSignifyLines returns the base64 decoded lines of a minisign or signify
+// file together with the raw comment lines, skipping the untrusted comment.
+func readSignifyLines(content []byte) ([][]byte, []string, error) {
+	var blobs [][]byte
+	var comments []string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "untrusted comment:") {
+			continue
+		}
+		if strings.HasPrefix(line, "trusted comment: ") {
+			comments = append(comments, strings.TrimPrefix(line, "trusted comment: "))
+			continue
+		}
+		blob, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid base64 line %q: %v", line, err)
+		}
+		blobs = append(blobs, blob)
+	}
+	return blobs, comments, scanner.Err()
+}
+
+func readEd25519PublicKey(key []byte) ([]byte, ed25519.PublicKey, error) {
+	blobs, _, err := readSignifyLines(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(blobs) != 1 || len(blobs[0]) != 2+8+ed25519.PublicKeySize || string(blobs[0][:2]) != "Ed" {
+		return nil, nil, fmt.Errorf("invalid public key")
+	}
+	return blobs[0][2:10], ed25519.PublicKey(blobs[0][10:]), nil
+}
+
+func verifyMinisign(key, sig []byte, data io.Reader) error {
+	keyID, pub, err := readEd25519PublicKey(key)
+	if err != nil {
+		return fmt.Errorf("invalid minisign key: %v", err)
+	}
+	blobs, comments, err := readSignifyLines(sig)
+	if err != nil {
+		return fmt.Errorf("invalid minisign signature: %v", err)
+	}
+	if len(blobs) != 2 || len(comments) != 1 || len(blobs[0]) != 2+8+ed25519.SignatureSize || len(blobs[1]) != ed25519.SignatureSize {
+		return fmt.Errorf("invalid minisign signature")
+	}
+	signature := blobs[0]
+	if !bytes.Equal(signature[2:10], keyID) {
+		return fmt.Errorf("minisign signature was made with a different key")
+	}
+
+	var message []byte
+	switch string(signature[:2]) {
+	case "Ed":
+		message, err = io.ReadAll(data)
+		if err != nil {
+			return err
+		}
+	case "ED":
+		hasher, _ := blake2b.New512(nil)
+		if _, err := io.Copy(hasher, data); err != nil {
+			return err
+		}
+		message = hasher.Sum(nil)
+	default:
+		return fmt.Errorf("unsupported minisign algorithm %q", signature[:2])
+	}
+
+	if !ed25519.Verify(pub, message, signature[10:]) {
+		return fmt.Errorf("bad minisign signature")
+	}
+	global := append(append([]byte{}, signature[10:]...), []byte(comments[0])...)
+	if !ed25519.Verify(pub, global, blobs[1]) {
+		return fmt.Errorf("bad minisign trusted comment signature")
+	}
+	return nil
+}
+
+func verifySignify(key, sig []byte, data io.Reader) error {
+	keyNum, pub, err := readEd25519PublicKey(key)
+	if err != nil {
+		return fmt.Errorf("invalid signify key: %v", err)
+	}
+	blobs, _, err := readSignifyLines(sig)
+	if err != nil {
+		return fmt.Errorf("invalid signify signature: %v", err)
+	}
+	if len(blobs) != 1 || len(blobs[0]) != 2+8+ed25519.SignatureSize || string(blobs[0][:2]) != "Ed" {
+		return fmt.Errorf("invalid signify signature")
+	}
+	if !bytes.Equal(blobs[0][2:10], keyNum) {
+		return fmt.Errorf("signify signature was made with a different key")
+	}
+	message, err := io.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pub, message, blobs[0][10:]) {
+		return fmt.Errorf("bad signify signature")
+	}
+	return nil
+}
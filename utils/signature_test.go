@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The vectors in testdata/signature were made with gpg (openpgp) and with
+// openssl ed25519 keys in the minisign and signify file formats. Only key "a"
+// signed data.txt.
+func TestVerifySignature(t *testing.T) {
+	dir := filepath.Join("testdata", "signature")
+	tampered := filepath.Join(t.TempDir(), "data.txt")
+	data, err := os.ReadFile(filepath.Join(dir, "data.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tampered, append(data, '!'), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		kind string
+		data string
+		sig  string
+		key  string
+		err  string
+	}{
+		{"openpgp armored", "openpgp", "data.txt", "data.txt.asc", "openpgp-a.asc", ""},
+		{"openpgp binary", "openpgp", "data.txt", "data.txt.gpgsig", "openpgp-a.asc", ""},
+		{"openpgp bad", "openpgp", tampered, "data.txt.asc", "openpgp-a.asc", "bad OpenPGP signature"},
+		{"openpgp wrong key", "openpgp", "data.txt", "data.txt.asc", "openpgp-b.gpg", "bad OpenPGP signature"},
+		{"minisign prehashed", "minisign", "data.txt", "data.txt.minisig", "minisign-a.pub", ""},
+		{"minisign legacy", "minisign", "data.txt", "data.txt-legacy.minisig", "minisign-a.pub", ""},
+		{"minisign bad", "minisign", tampered, "data.txt.minisig", "minisign-a.pub", "bad minisign signature"},
+		{"minisign bad legacy", "minisign", tampered, "data.txt-legacy.minisig", "minisign-a.pub", "bad minisign signature"},
+		{"minisign wrong key", "minisign", "data.txt", "data.txt.minisig", "minisign-b.pub", "different key"},
+		{"minisign wrong key same id", "minisign", "data.txt", "data.txt.minisig", "minisign-b-same-id.pub", "bad minisign signature"},
+		{"minisign as signify", "signify", "data.txt", "data.txt.minisig", "signify-a.pub", "invalid signify signature"},
+		{"signify", "signify", "data.txt", "data.txt.sig", "signify-a.pub", ""},
+		{"signify bad", "signify", tampered, "data.txt.sig", "signify-a.pub", "bad signify signature"},
+		{"signify wrong key", "signify", "data.txt", "data.txt.sig", "signify-b.pub", "different key"},
+		{"unknown kind", "x509", "data.txt", "data.txt.sig", "signify-a.pub", "unsupported signature kind"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dataPath := test.data
+			if !filepath.IsAbs(dataPath) {
+				dataPath = filepath.Join(dir, dataPath)
+			}
+			err := VerifySignature(test.kind, dataPath, filepath.Join(dir, test.sig), filepath.Join(dir, test.key))
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("expected a valid signature, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected an error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestVerifyMinisignTrustedComment(t *testing.T) {
+	dir := filepath.Join("testdata", "signature")
+	sig, err := os.ReadFile(filepath.Join(dir, "data.txt.minisig"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := filepath.Join(t.TempDir(), "data.txt.minisig")
+	content := strings.Replace(string(sig), "timestamp:1700000000", "timestamp:1800000000", 1)
+	if err := os.WriteFile(forged, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = VerifySignature("minisign", filepath.Join(dir, "data.txt"), forged, filepath.Join(dir, "minisign-a.pub"))
+	if err == nil || !strings.Contains(err.Error(), "trusted comment") {
+		t.Fatalf("expected a trusted comment error, got %v", err)
+	}
+}